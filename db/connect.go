@@ -5,16 +5,18 @@ import (
 	"os"
 	"time"
 
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func Connect() (*pgx.Conn, error) {
+// Connect opens a connection pool; DATABASE_URL may tune it with
+// pool_max_conns, pool_min_conns etc.
+func Connect() (*pgxpool.Pool, error) {
     connString := os.Getenv("DATABASE_URL")
-    return pgx.Connect(context.Background(), connString)
+    return pgxpool.New(context.Background(), connString)
 }
 
-func PingDB(conn *pgx.Conn) error {
+func PingDB(pool *pgxpool.Pool) error {
     ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
     defer cancel()
-    return conn.Ping(ctx)
-}
\ No newline at end of file
+    return pool.Ping(ctx)
+}
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS file_versions;
+DROP TABLE IF EXISTS share_links;
+DROP TABLE IF EXISTS chunk_uploads;
+DROP TABLE IF EXISTS files;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,13 @@
+-- Content-addressable storage: one row per unique SHA-256
+CREATE TABLE IF NOT EXISTS blobs (
+    id TEXT PRIMARY KEY,
+    size BIGINT NOT NULL,
+    ref_count INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS last_referenced_at TIMESTAMP NOT NULL DEFAULT NOW();
+CREATE INDEX IF NOT EXISTS idx_blobs_ref_count ON blobs(ref_count);
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS blob_id TEXT REFERENCES blobs(id);
+CREATE INDEX IF NOT EXISTS idx_files_blob_id ON files(blob_id);
@@ -0,0 +1,7 @@
+ALTER TABLE chunk_uploads DROP COLUMN IF EXISTS file_id;
+
+DELETE FROM file_versions WHERE file_path IS NULL;
+ALTER TABLE file_versions DROP COLUMN IF EXISTS blob_id;
+ALTER TABLE file_versions ALTER COLUMN file_path SET NOT NULL;
+
+ALTER TABLE files DROP COLUMN IF EXISTS version;
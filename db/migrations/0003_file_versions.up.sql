@@ -0,0 +1,10 @@
+-- The files row holds the current content and version number; previous
+-- contents are archived in file_versions and reference blobs the same way
+ALTER TABLE files ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+
+ALTER TABLE file_versions ALTER COLUMN file_path DROP NOT NULL;
+ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS blob_id TEXT REFERENCES blobs(id);
+CREATE INDEX IF NOT EXISTS idx_file_versions_blob_id ON file_versions(blob_id);
+
+-- Chunked uploads can target an existing file to create a new version
+ALTER TABLE chunk_uploads ADD COLUMN IF NOT EXISTS file_id TEXT REFERENCES files(id) ON DELETE CASCADE;
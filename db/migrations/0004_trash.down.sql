@@ -0,0 +1,5 @@
+-- Without the column trashed rows would come back to life, so purge them
+DELETE FROM files WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS idx_files_deleted_at;
+ALTER TABLE files DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,5 @@
+-- Deleting moves items to the trash. A trashed folder and every descendant
+-- trashed with it share the same deleted_at, which is how a restore finds
+-- the subtree to bring back.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS idx_files_deleted_at ON files(deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_chunk_uploads_user_status;
+
+ALTER TABLE users DROP COLUMN IF EXISTS quota_bytes;
+ALTER TABLE users DROP COLUMN IF EXISTS plan_id;
+
+DROP TABLE IF EXISTS plans;
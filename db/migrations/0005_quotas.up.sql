@@ -0,0 +1,19 @@
+-- Storage plans carry the default quota; quota_bytes NULL means unlimited
+CREATE TABLE IF NOT EXISTS plans (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    quota_bytes BIGINT
+);
+
+INSERT INTO plans (id, name, quota_bytes) VALUES
+    ('free', 'Free', 10737418240),      -- 10 GiB
+    ('pro', 'Pro', 1099511627776),      -- 1 TiB
+    ('unlimited', 'Unlimited', NULL)
+ON CONFLICT (id) DO NOTHING;
+
+-- Every user is on a plan; quota_bytes overrides the plan's quota for that user
+ALTER TABLE users ADD COLUMN IF NOT EXISTS plan_id TEXT NOT NULL DEFAULT 'free' REFERENCES plans(id);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_bytes BIGINT;
+
+-- Usage is summed per user on demand
+CREATE INDEX IF NOT EXISTS idx_chunk_uploads_user_status ON chunk_uploads(user_id, status);
@@ -0,0 +1,5 @@
+DELETE FROM chunk_uploads WHERE protocol <> 'chunked';
+
+ALTER TABLE chunk_uploads DROP COLUMN IF EXISTS metadata;
+ALTER TABLE chunk_uploads DROP COLUMN IF EXISTS upload_offset;
+ALTER TABLE chunk_uploads DROP COLUMN IF EXISTS protocol;
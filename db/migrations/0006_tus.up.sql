@@ -0,0 +1,6 @@
+-- tus uploads share chunk_uploads with the chunked protocol. Their parts are
+-- stored as chunk_0, chunk_1, ... in the order they were appended, and
+-- upload_offset tracks how many bytes have been received.
+ALTER TABLE chunk_uploads ADD COLUMN IF NOT EXISTS protocol TEXT NOT NULL DEFAULT 'chunked';
+ALTER TABLE chunk_uploads ADD COLUMN IF NOT EXISTS upload_offset BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE chunk_uploads ADD COLUMN IF NOT EXISTS metadata TEXT;
@@ -0,0 +1,3 @@
+ALTER TABLE chunk_uploads DROP COLUMN IF EXISTS expected_checksum;
+
+DROP TABLE IF EXISTS chunk_upload_parts;
@@ -0,0 +1,17 @@
+-- One row per received chunk with the SHA-256 the server computed, so
+-- re-sends are idempotent and assembly can detect corrupted chunks
+CREATE TABLE IF NOT EXISTS chunk_upload_parts (
+    upload_id TEXT NOT NULL REFERENCES chunk_uploads(id) ON DELETE CASCADE,
+    chunk_number INTEGER NOT NULL,
+    size BIGINT NOT NULL,
+    checksum TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (upload_id, chunk_number)
+);
+
+-- Optional SHA-256 of the whole file, checked after assembly
+ALTER TABLE chunk_uploads ADD COLUMN IF NOT EXISTS expected_checksum TEXT;
+
+-- Collapse chunk numbers recorded more than once by repeated sends
+UPDATE chunk_uploads SET uploaded_chunks = ARRAY(SELECT DISTINCT unnest(uploaded_chunks) ORDER BY 1)
+WHERE protocol = 'chunked';
@@ -0,0 +1,3 @@
+UPDATE chunk_uploads SET status='failed' WHERE status='assembling';
+
+ALTER TABLE chunk_uploads DROP COLUMN IF EXISTS error;
@@ -0,0 +1,3 @@
+-- Sessions move pending -> uploading -> assembling -> completed | failed.
+-- A failed session records why; a completed one points file_id at the result.
+ALTER TABLE chunk_uploads ADD COLUMN IF NOT EXISTS error TEXT;
@@ -0,0 +1,2 @@
+ALTER TABLE chunk_uploads DROP COLUMN IF EXISTS on_conflict;
+ALTER TABLE chunk_uploads DROP COLUMN IF EXISTS parent_id;
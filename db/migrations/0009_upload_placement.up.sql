@@ -0,0 +1,4 @@
+-- Upload sessions remember which folder the file goes into and how to handle
+-- a name that is already taken there
+ALTER TABLE chunk_uploads ADD COLUMN IF NOT EXISTS parent_id TEXT REFERENCES files(id) ON DELETE CASCADE;
+ALTER TABLE chunk_uploads ADD COLUMN IF NOT EXISTS on_conflict TEXT;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_chunk_uploads_status_expires;
+UPDATE chunk_uploads SET status='failed', error='upload session expired' WHERE status='expired';
+ALTER TABLE chunk_uploads DROP COLUMN IF EXISTS assembly_started_at;
@@ -0,0 +1,6 @@
+-- The upload reaper moves sessions past expires_at to 'expired' and fails
+-- sessions that have been assembling for too long, which needs to know when
+-- assembly started
+ALTER TABLE chunk_uploads ADD COLUMN IF NOT EXISTS assembly_started_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_chunk_uploads_status_expires ON chunk_uploads(status, expires_at);
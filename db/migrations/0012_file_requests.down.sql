@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_chunk_uploads_share_id;
+ALTER TABLE chunk_uploads DROP COLUMN IF EXISTS uploader_email;
+ALTER TABLE chunk_uploads DROP COLUMN IF EXISTS uploader_name;
+ALTER TABLE chunk_uploads DROP COLUMN IF EXISTS share_id;
+DELETE FROM share_links WHERE kind='upload';
+ALTER TABLE share_links DROP COLUMN IF EXISTS require_uploader_info;
+ALTER TABLE share_links DROP COLUMN IF EXISTS allowed_extensions;
+ALTER TABLE share_links DROP COLUMN IF EXISTS max_file_size;
+ALTER TABLE share_links DROP COLUMN IF EXISTS kind;
@@ -0,0 +1,15 @@
+-- A share link either lets people read the shared item or, for a file
+-- request, lets anyone with the link upload into the shared folder without
+-- seeing what is in it
+ALTER TABLE share_links ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT 'read' CHECK (kind IN ('read', 'upload'));
+ALTER TABLE share_links ADD COLUMN IF NOT EXISTS max_file_size BIGINT;
+ALTER TABLE share_links ADD COLUMN IF NOT EXISTS allowed_extensions TEXT[];
+ALTER TABLE share_links ADD COLUMN IF NOT EXISTS require_uploader_info BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Upload sessions started through a file request remember the link and
+-- who the uploader said they were; the session belongs to the link's owner
+ALTER TABLE chunk_uploads ADD COLUMN IF NOT EXISTS share_id TEXT REFERENCES share_links(id) ON DELETE SET NULL;
+ALTER TABLE chunk_uploads ADD COLUMN IF NOT EXISTS uploader_name TEXT;
+ALTER TABLE chunk_uploads ADD COLUMN IF NOT EXISTS uploader_email TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_chunk_uploads_share_id ON chunk_uploads(share_id) WHERE share_id IS NOT NULL;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS share_access_log;
+ALTER TABLE share_links DROP COLUMN IF EXISTS download_count;
+ALTER TABLE share_links DROP COLUMN IF EXISTS max_downloads;
@@ -0,0 +1,20 @@
+-- Read links can be limited to a number of downloads (one-time links allow
+-- one); download_count is claimed atomically before each download
+ALTER TABLE share_links ADD COLUMN IF NOT EXISTS max_downloads INTEGER CHECK (max_downloads > 0);
+ALTER TABLE share_links ADD COLUMN IF NOT EXISTS download_count INTEGER NOT NULL DEFAULT 0;
+
+-- Every use of a share link, allowed or refused, for auditing who fetched what
+CREATE TABLE IF NOT EXISTS share_access_log (
+    id TEXT PRIMARY KEY,
+    share_id TEXT NOT NULL REFERENCES share_links(id) ON DELETE CASCADE,
+    file_id TEXT REFERENCES files(id) ON DELETE SET NULL,
+    action TEXT NOT NULL,
+    outcome TEXT NOT NULL CHECK (outcome IN ('success', 'denied')),
+    reason TEXT,
+    ip TEXT,
+    user_agent TEXT,
+    bytes_served BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_share_access_log_share_created ON share_access_log(share_id, created_at DESC);
@@ -0,0 +1,9 @@
+-- Failed share password attempts, counted per link ("share:<id>") and per
+-- client address ("ip:<address>"). Too many failures within the window lock
+-- the key until locked_until.
+CREATE TABLE IF NOT EXISTS share_unlock_attempts (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    window_start TIMESTAMP NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP
+);
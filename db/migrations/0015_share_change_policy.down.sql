@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS notifications;
+DROP INDEX IF EXISTS idx_share_links_revoke_on_change;
+ALTER TABLE share_links DROP COLUMN IF EXISTS revoked_reason;
+ALTER TABLE share_links DROP COLUMN IF EXISTS revoked_at;
+ALTER TABLE share_links DROP COLUMN IF EXISTS pinned_checksum;
+ALTER TABLE share_links DROP COLUMN IF EXISTS pinned_version;
+ALTER TABLE share_links DROP COLUMN IF EXISTS on_change;
@@ -0,0 +1,30 @@
+-- What a read link does when the item it points at changes: follow the
+-- current content (the default), stay pinned to the version it was created
+-- at, or stop working. Pinned links remember the version's checksum so the
+-- content they serve can't drift.
+ALTER TABLE share_links ADD COLUMN IF NOT EXISTS on_change TEXT NOT NULL DEFAULT 'follow'
+    CHECK (on_change IN ('follow', 'pin', 'revoke'));
+ALTER TABLE share_links ADD COLUMN IF NOT EXISTS pinned_version INTEGER;
+ALTER TABLE share_links ADD COLUMN IF NOT EXISTS pinned_checksum TEXT;
+
+-- Revoked links are kept, with their access log, until the owner deletes them
+ALTER TABLE share_links ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMP;
+ALTER TABLE share_links ADD COLUMN IF NOT EXISTS revoked_reason TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_share_links_revoke_on_change ON share_links(file_id)
+    WHERE on_change = 'revoke' AND revoked_at IS NULL;
+
+-- Messages for a user about things that happened to their items, such as a
+-- share link being revoked
+CREATE TABLE IF NOT EXISTS notifications (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    message TEXT NOT NULL,
+    share_id TEXT REFERENCES share_links(id) ON DELETE SET NULL,
+    file_id TEXT REFERENCES files(id) ON DELETE SET NULL,
+    read_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user_created ON notifications(user_id, created_at DESC);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_chunk_uploads_owner_status;
+ALTER TABLE chunk_uploads DROP COLUMN IF EXISTS owner_id;
@@ -0,0 +1,11 @@
+-- Upload sessions reserve quota of the owner of the folder they upload into,
+-- who may not be the uploader when the folder is shared with them. user_id
+-- stays the uploader, who is the only one who can send to the session.
+ALTER TABLE chunk_uploads ADD COLUMN IF NOT EXISTS owner_id TEXT REFERENCES users(id) ON DELETE CASCADE;
+UPDATE chunk_uploads u SET owner_id = COALESCE(
+    (SELECT f.user_id FROM files f WHERE f.id = COALESCE(u.file_id, u.parent_id)),
+    u.user_id)
+WHERE owner_id IS NULL;
+ALTER TABLE chunk_uploads ALTER COLUMN owner_id SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_chunk_uploads_owner_status ON chunk_uploads(owner_id, status);
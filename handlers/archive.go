@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pk0205/dropbox-2.0/models"
+	"github.com/pk0205/dropbox-2.0/repository"
+	"github.com/pk0205/dropbox-2.0/storage"
+)
+
+// Archive formats accepted in ?format=
+const (
+	archiveZip   = "zip"
+	archiveTarGz = "tar.gz"
+)
+
+// MaxArchiveItems caps how many items a multi-select archive can name
+const MaxArchiveItems = 1000
+
+// unnamedArchiveEntry stands in for a name that can't be a path segment
+const unnamedArchiveEntry = "unnamed"
+
+// archiveEntry is one file or folder in an archive, at its path inside it
+type archiveEntry struct {
+	Path string
+	File models.File
+}
+
+// archiveWriter writes entries in one archive format
+type archiveWriter interface {
+	AddDir(name string, modTime time.Time) error
+	AddFile(name string, size int64, modTime time.Time, content io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) AddDir(name string, modTime time.Time) error {
+	_, err := a.zw.CreateHeader(&zip.FileHeader{Name: name + "/", Modified: modTime})
+	return err
+}
+
+func (a *zipArchive) AddFile(name string, size int64, modTime time.Time, content io.Reader) error {
+	w, err := a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarGzArchive) AddDir(name string, modTime time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755, ModTime: modTime})
+}
+
+func (a *tarGzArchive) AddFile(name string, size int64, modTime time.Time, content io.Reader) error {
+	err := a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644, ModTime: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, content)
+	return err
+}
+
+func (a *tarGzArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// archiveFormat validates ?format=, defaulting to zip
+func archiveFormat(c *fiber.Ctx) (string, bool) {
+	switch format := c.Query("format", archiveZip); format {
+	case archiveZip:
+		return archiveZip, true
+	case archiveTarGz, "tgz":
+		return archiveTarGz, true
+	}
+	return "", false
+}
+
+// subtreeEntries lays out a subtree from FileRepo.Subtree (parents first)
+// below base. With an empty base the root itself is left out and its
+// contents sit at the top of the archive.
+func subtreeEntries(items []models.File, base string) []archiveEntry {
+	if len(items) == 0 {
+		return nil
+	}
+
+	paths := map[string]string{items[0].ID: base}
+	var entries []archiveEntry
+	if base != "" {
+		entries = append(entries, archiveEntry{Path: base, File: items[0]})
+	}
+	for _, item := range items[1:] {
+		if item.ParentID == nil {
+			continue
+		}
+		parent, ok := paths[*item.ParentID]
+		if !ok {
+			continue
+		}
+		p := path.Join(parent, archiveName(item.OriginalName))
+		paths[item.ID] = p
+		entries = append(entries, archiveEntry{Path: p, File: item})
+	}
+	return entries
+}
+
+// streamArchive sends entries as an archive built while it is sent, reading
+// one file at a time from storage so nothing is staged on disk or in memory.
+// Once streaming has started errors can only be logged and the archive is
+// cut short. sent, if not nil, is told how many bytes went out, as with
+// download.Sent.
+func streamArchive(c *fiber.Ctx, store storage.Backend, name, format string, entries []archiveEntry, sent func(int, int64)) error {
+	pr, pw := io.Pipe()
+
+	var archive archiveWriter
+	if format == archiveTarGz {
+		gz := gzip.NewWriter(pw)
+		archive = &tarGzArchive{gz: gz, tw: tar.NewWriter(gz)}
+		c.Set("Content-Type", "application/gzip")
+		name += ".tar.gz"
+	} else {
+		archive = &zipArchive{zw: zip.NewWriter(pw)}
+		c.Set("Content-Type", "application/zip")
+		name += ".zip"
+	}
+	c.Set("Content-Disposition", attachment(name))
+
+	go func() {
+		used := map[string]bool{}
+		for _, e := range entries {
+			entryPath := uniqueArchivePath(used, e.Path, e.File.IsFolder)
+			var err error
+			if e.File.IsFolder {
+				err = archive.AddDir(entryPath, e.File.UpdatedAt)
+			} else {
+				err = addArchiveFile(store, archive, entryPath, &e.File)
+			}
+			if err != nil {
+				log.Printf("archive %s: %s: %v", name, e.Path, err)
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(archive.Close())
+	}()
+
+	return c.Status(200).SendStream(reportSent(pr, 200, sent))
+}
+
+// addArchiveFile copies one file's content from storage into the archive
+func addArchiveFile(store storage.Backend, archive archiveWriter, name string, file *models.File) error {
+	reader, err := store.Get(context.Background(), contentKey(file.BlobID, file.FilePath))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return archive.AddFile(name, file.FileSize, file.UpdatedAt, reader)
+}
+
+// archiveName makes an item name safe as one segment of an archive path, so
+// names from before validName, or synced from elsewhere, can't climb out of
+// the extraction directory (zip-slip) or collapse into their parent
+func archiveName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\':
+			return '_'
+		case 0:
+			return -1
+		}
+		return r
+	}, name)
+	if strings.TrimSpace(name) == "" || name == "." || name == ".." {
+		return unnamedArchiveEntry
+	}
+	return name
+}
+
+// uniqueArchivePath keeps two items from landing on the same path, naming
+// the later one like resolveName does: "report (1).pdf"
+func uniqueArchivePath(used map[string]bool, p string, isFolder bool) string {
+	base, ext := p, ""
+	if !isFolder {
+		ext = path.Ext(p)
+		base = strings.TrimSuffix(p, ext)
+	}
+	candidate := p
+	for n := 1; used[candidate]; n++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	used[candidate] = true
+	return candidate
+}
+
+// DownloadFolderArchive streams a folder and everything in it as a ZIP
+// (or ?format=tar.gz), with paths relative to the folder
+func DownloadFolderArchive(repo *repository.Repository, store storage.Backend) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		folderID := c.Params("folderId")
+		userID := c.Locals("userID").(string)
+
+		format, ok := archiveFormat(c)
+		if !ok {
+			return c.Status(400).JSON(fiber.Map{"error": "format must be zip or tar.gz"})
+		}
+
+		folder, err := repo.Files.Get(context.Background(), folderID, userID)
+		if err != nil || !folder.IsFolder {
+			return c.Status(404).JSON(fiber.Map{"error": "Folder not found"})
+		}
+
+		items, err := repo.Files.Subtree(context.Background(), folderID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to list folder"})
+		}
+
+		return streamArchive(c, store, folder.OriginalName, format, subtreeEntries(items, ""), nil)
+	}
+}
+
+// DownloadSharedArchive is DownloadFolderArchive for a shared folder
+func DownloadSharedArchive(repo *repository.Repository, store storage.Backend) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		shared, err := openShare(repo, c)
+		if shared == nil {
+			return err
+		}
+		if !shared.File.IsFolder {
+			return c.Status(400).JSON(fiber.Map{"error": "Only shared folders can be downloaded as an archive"})
+		}
+
+		format, ok := archiveFormat(c)
+		if !ok {
+			return c.Status(400).JSON(fiber.Map{"error": "format must be zip or tar.gz"})
+		}
+
+		items, err := repo.Files.Subtree(context.Background(), shared.File.ID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to list folder"})
+		}
+
+		// An archive counts as one download of the share
+		if ok, err := claimShareDownload(repo, c, &shared.Share); !ok {
+			return err
+		}
+		sent := recordShareSent(repo, newShareAccess(c, &shared.Share, shared.File.ID, models.ShareActionArchive))
+		return streamArchive(c, store, shared.File.OriginalName, format, subtreeEntries(items, ""), sent)
+	}
+}
+
+// DownloadSelectionArchive streams an arbitrary selection of the user's
+// files and folders as one archive, each at the top level under its name
+func DownloadSelectionArchive(repo *repository.Repository, store storage.Backend) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(string)
+
+		req := struct {
+			FileIDs []string `json:"fileIds" form:"fileIds"`
+			Name    string   `json:"name" form:"name"` // Archive name without extension
+		}{}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if len(req.FileIDs) == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "fileIds is required"})
+		}
+		if len(req.FileIDs) > MaxArchiveItems {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("At most %d items can be archived at once", MaxArchiveItems)})
+		}
+
+		format, ok := archiveFormat(c)
+		if !ok {
+			return c.Status(400).JSON(fiber.Map{"error": "format must be zip or tar.gz"})
+		}
+
+		name := strings.TrimSpace(req.Name)
+		if !validName(name) {
+			name = "download"
+		}
+
+		var entries []archiveEntry
+		seen, topLevel := map[string]bool{}, map[string]bool{}
+		for _, id := range req.FileIDs {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			item, err := repo.Files.Get(context.Background(), id, userID)
+			if err != nil {
+				return c.Status(404).JSON(fiber.Map{"error": "File not found: " + id})
+			}
+			// Items from different folders may share a name
+			base := uniqueArchivePath(topLevel, archiveName(item.OriginalName), item.IsFolder)
+			if !item.IsFolder {
+				entries = append(entries, archiveEntry{Path: base, File: *item})
+				continue
+			}
+
+			items, err := repo.Files.Subtree(context.Background(), id)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to list folder"})
+			}
+			entries = append(entries, subtreeEntries(items, base)...)
+		}
+
+		return streamArchive(c, store, name, format, entries, nil)
+	}
+}
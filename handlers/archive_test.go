@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pk0205/dropbox-2.0/models"
+)
+
+func TestArchiveName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"..", "unnamed"},
+		{".", "unnamed"},
+		{"", "unnamed"},
+		{"   ", "unnamed"},
+		{"../x", ".._x"},
+		{"a/../../b", "a_.._.._b"},
+		{`..\evil`, ".._evil"},
+		{"/etc/passwd", "_etc_passwd"},
+		{"nul\x00.txt", "nul.txt"},
+		{"\x00", "unnamed"},
+		{"...", "..."},
+	}
+	for _, tt := range tests {
+		if got := archiveName(tt.name); got != tt.want {
+			t.Errorf("archiveName(%q) = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueArchivePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		used     []string
+		path     string
+		isFolder bool
+		want     string
+	}{
+		{"free", nil, "report.pdf", false, "report.pdf"},
+		{"taken file", []string{"report.pdf"}, "report.pdf", false, "report (1).pdf"},
+		{"taken twice", []string{"report.pdf", "report (1).pdf"}, "report.pdf", false, "report (2).pdf"},
+		{"folder keeps dots", []string{"v1.2"}, "v1.2", true, "v1.2 (1)"},
+		{"no extension", []string{"notes"}, "notes", false, "notes (1)"},
+		{"nested", []string{"docs/a.txt"}, "docs/a.txt", false, "docs/a (1).txt"},
+		{"case sensitive", []string{"A.txt"}, "a.txt", false, "a.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used := map[string]bool{}
+			for _, p := range tt.used {
+				used[p] = true
+			}
+			got := uniqueArchivePath(used, tt.path, tt.isFolder)
+			if got != tt.want {
+				t.Errorf("uniqueArchivePath(%q) = %q; want %q", tt.path, got, tt.want)
+			}
+			if !used[got] {
+				t.Errorf("uniqueArchivePath(%q) did not mark %q used", tt.path, got)
+			}
+		})
+	}
+}
+
+func TestSubtreeEntriesSanitizesNames(t *testing.T) {
+	root, sub, gone := "root", "sub", "gone"
+	items := []models.File{
+		{ID: root, OriginalName: "Project", IsFolder: true},
+		{ID: sub, ParentID: &root, OriginalName: "..", IsFolder: true},
+		{ID: "a", ParentID: &sub, OriginalName: "../../etc/passwd"},
+		{ID: "b", ParentID: &root, OriginalName: "ok.txt"},
+		{ID: "orphan", ParentID: &gone, OriginalName: "lost.txt"},
+	}
+
+	var got []string
+	for _, e := range subtreeEntries(items, "") {
+		got = append(got, e.Path)
+	}
+	want := []string{"unnamed", "unnamed/.._.._etc_passwd", "ok.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("subtreeEntries paths = %q; want %q", got, want)
+	}
+
+	got = nil
+	for _, e := range subtreeEntries(items, "Project") {
+		got = append(got, e.Path)
+	}
+	want = []string{"Project", "Project/unnamed", "Project/unnamed/.._.._etc_passwd", "Project/ok.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("subtreeEntries paths = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+	"github.com/pk0205/dropbox-2.0/repository"
+	"github.com/pk0205/dropbox-2.0/storage"
+)
+
+// errNotAFile is returned when an upload targets a folder
+var errNotAFile = errors.New("target is a folder, not a file")
+
+// contentKey returns the storage key holding a file's bytes. Files are
+// stored by checksum under blobs/; rows from before the content-addressable
+// store still point at their own path.
+func contentKey(blobID *string, filePath string) string {
+	if blobID != nil && *blobID != "" {
+		return storage.BlobKey(*blobID)
+	}
+	return objectKey(filePath)
+}
+
+// isSHA256Hex reports whether s looks like a lower case hex SHA-256
+func isSHA256Hex(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// storeBlob writes content under its checksum unless an identical blob is already stored
+func storeBlob(repo *repository.Repository, store storage.Backend, checksum string, content io.Reader) error {
+	exists, err := repo.Blobs.Touch(context.Background(), checksum)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	_, err = store.Put(context.Background(), storage.BlobKey(checksum), content)
+	return err
+}
+
+// storeBlobFile is storeBlob for content already spooled to a file from
+// storage.CreateTemp: the file is moved into place when the blob is new and
+// discarded when an identical blob is already stored
+func storeBlobFile(repo *repository.Repository, store storage.Backend, checksum, path string) error {
+	exists, err := repo.Blobs.Touch(context.Background(), checksum)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.Remove(path)
+	}
+	return storage.PutFile(context.Background(), store, storage.BlobKey(checksum), path)
+}
+
+// Conflict policies for uploads whose name is already taken in the folder,
+// alongside onConflictRename
+const (
+	onConflictVersion = "version" // Store the upload as a new version of the existing file
+	onConflictReject  = "reject"
+)
+
+// uploadConflictPolicy validates a requested conflict policy, falling back
+// to UPLOAD_CONFLICT_POLICY and then to versioning
+func uploadConflictPolicy(requested string) (string, bool) {
+	if requested == "" {
+		requested = os.Getenv("UPLOAD_CONFLICT_POLICY")
+		if requested == "" {
+			return onConflictVersion, true
+		}
+	}
+	switch requested {
+	case onConflictRename, onConflictVersion, onConflictReject:
+		return requested, true
+	}
+	return "", false
+}
+
+// sniffMimeType detects a MIME type from the first bytes of the content.
+// Sniffing only recognises a limited set of formats, so generic results fall
+// back to the file extension.
+func sniffMimeType(head []byte, name string) string {
+	mimeType := http.DetectContentType(head)
+	if strings.HasPrefix(mimeType, "application/octet-stream") || strings.HasPrefix(mimeType, "text/plain") {
+		if byExt := mime.TypeByExtension(filepath.Ext(name)); byExt != "" {
+			return byExt
+		}
+	}
+	return mimeType
+}
+
+// checkFolder verifies that parentID (nil for the root) is one of the user's folders
+func checkFolder(repo *repository.Repository, userID string, parentID *string) error {
+	if parentID == nil {
+		return nil
+	}
+	parent, err := repo.Files.Get(context.Background(), *parentID, userID)
+	if err == pgx.ErrNoRows || (err == nil && !parent.IsFolder) {
+		return errInvalidParent
+	}
+	return err
+}
+
+// uploadTarget says where uploaded content should land
+type uploadTarget struct {
+	UserID       string  // Owner of the result, who may not be the uploader
+	FileID       string  // Explicit existing file to version, optional
+	ParentID     *string // Folder to create the file in (nil for root)
+	OriginalName string
+	OnConflict   string // Policy when the name is taken, see uploadConflictPolicy
+	MimeType     string
+	UploadID     string // Chunked upload session being completed, optional
+}
+
+var (
+	errInvalidName           = errors.New("invalid file name")
+	errInvalidConflictPolicy = errors.New("onConflict must be rename, version or reject")
+)
+
+// newUploadTarget validates where an upload will land before any content is
+// received: fileID (optional) names a file to version, otherwise the upload
+// goes into parentID ("" for the root) under name. userID is the uploader,
+// who needs the editor role on a destination owned by someone else. With the
+// reject policy a name that is already taken fails straight away.
+func newUploadTarget(repo *repository.Repository, userID, fileID, parentID, name, onConflict string) (*uploadTarget, error) {
+	policy, ok := uploadConflictPolicy(onConflict)
+	if !ok {
+		return nil, errInvalidConflictPolicy
+	}
+	target := &uploadTarget{UserID: userID, OriginalName: strings.TrimSpace(name), OnConflict: policy}
+
+	// Uploads into someone else's shared folder or file belong to its owner
+	if fileID != "" {
+		existing, _, err := accessibleFile(repo, fileID, userID, models.RoleEditor)
+		if err != nil {
+			return nil, err
+		}
+		if existing.IsFolder {
+			return nil, errNotAFile
+		}
+		target.UserID = existing.UserID
+		target.FileID = fileID
+		target.OriginalName = existing.OriginalName
+		return target, nil
+	}
+
+	if !validName(target.OriginalName) {
+		return nil, errInvalidName
+	}
+	target.ParentID = folderParam(parentID)
+	ownerID, err := writableFolder(repo, userID, target.ParentID)
+	if err != nil {
+		return nil, err
+	}
+	target.UserID = ownerID
+
+	if policy == onConflictReject {
+		taken, err := repo.Files.NameExists(context.Background(), target.UserID, target.ParentID, target.OriginalName, "")
+		if err != nil {
+			return nil, err
+		}
+		if taken {
+			return nil, errNameConflict
+		}
+	}
+	return target, nil
+}
+
+// uploadErrorStatus maps errors from newUploadTarget and saveUploadedContent
+// to a response status and message, or 0 for unexpected errors
+func uploadErrorStatus(err error) (int, string) {
+	switch err {
+	case pgx.ErrNoRows, errNotAFile:
+		return 404, "File not found"
+	case errInvalidName:
+		return 400, "Invalid file name"
+	case errInvalidConflictPolicy:
+		return 400, "onConflict must be rename, version or reject"
+	case errInvalidParent:
+		return 400, "Destination folder not found"
+	case errNameConflict:
+		return 409, "An item with this name already exists"
+	case errQuotaExceeded:
+		return 413, "Storage quota exceeded"
+	case errForbidden:
+		return 403, "Permission denied"
+	}
+	return 0, ""
+}
+
+// savedUpload describes the file an upload was recorded as
+type savedUpload struct {
+	FileID   string
+	FileName string // Differs from the uploaded name when renamed to avoid a conflict
+	Version  int
+	Checksum string
+	MimeType string
+}
+
+// saveUploadedContent records stored content as a file in target.ParentID.
+// It becomes a new version of target.FileID, or of a file with the same name
+// when the conflict policy says so. It enforces the user's quota, takes a
+// reference on the blob and marks target.UploadID completed.
+func saveUploadedContent(repo *repository.Repository, target uploadTarget, size int64, checksum string) (*savedUpload, error) {
+	saved := &savedUpload{FileName: target.OriginalName, Checksum: checksum, MimeType: target.MimeType}
+	err := repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+		var existing *models.File
+		var err error
+		if target.FileID != "" {
+			existing, err = tx.Files.GetForUpdate(context.Background(), target.FileID, target.UserID)
+			if err != nil {
+				return err
+			}
+			if existing.IsFolder {
+				return errNotAFile
+			}
+			saved.FileName = existing.OriginalName
+		} else {
+			// Name checks and the insert happen under the tree lock
+			if err := tx.Files.LockTree(context.Background(), target.UserID); err != nil {
+				return err
+			}
+			if err := checkFolder(tx, target.UserID, target.ParentID); err != nil {
+				return err
+			}
+
+			existing, err = tx.Files.FindByNameForUpdate(context.Background(), target.UserID, target.ParentID, target.OriginalName)
+			if err == pgx.ErrNoRows {
+				existing, err = nil, nil
+			}
+			if err != nil {
+				return err
+			}
+
+			// Only a file can take a new version; a folder with the name is a conflict
+			if existing != nil && (existing.IsFolder || target.OnConflict != onConflictVersion) {
+				if target.OnConflict == onConflictReject {
+					return errNameConflict
+				}
+				saved.FileName, err = resolveName(tx, target.UserID, target.ParentID, target.OriginalName, "", false, onConflictRename)
+				if err != nil {
+					return err
+				}
+				existing = nil
+			}
+		}
+
+		// A new version replaces the current size; previous versions aren't counted
+		delta := size
+		if existing != nil {
+			delta -= existing.FileSize
+		}
+		if err := checkQuota(tx, target.UserID, delta, target.UploadID); err != nil {
+			return err
+		}
+
+		if err := tx.Blobs.AddRef(context.Background(), checksum, size); err != nil {
+			return err
+		}
+
+		if existing == nil {
+			// Brand new file
+			saved.FileID = uuid.New().String()
+			saved.Version = 1
+			err = tx.Files.Create(context.Background(), &models.File{
+				ID:           saved.FileID,
+				UserID:       target.UserID,
+				FileName:     saved.FileID + filepath.Ext(saved.FileName),
+				OriginalName: saved.FileName,
+				BlobID:       &checksum,
+				FileSize:     size,
+				MimeType:     target.MimeType,
+				Checksum:     checksum,
+				ParentID:     target.ParentID,
+				Version:      1,
+				CreatedAt:    time.Now(),
+				UpdatedAt:    time.Now(),
+			})
+		} else {
+			// Archive the current content (its blob reference moves with it)
+			// and make the upload the new current version
+			saved.FileID = existing.ID
+			saved.Version = existing.Version + 1
+			if err := archiveVersion(tx, existing); err != nil {
+				return err
+			}
+			if err := revokeSharesOnChange(tx, existing, changeModified); err != nil {
+				return err
+			}
+			err = tx.Files.SetContent(context.Background(), existing.ID, checksum, size, target.MimeType, saved.Version)
+		}
+		if err != nil || target.UploadID == "" {
+			return err
+		}
+		err = tx.Uploads.Complete(context.Background(), target.UploadID, saved.FileID)
+		if err == pgx.ErrNoRows {
+			return errUploadAbandoned // Reaped while assembling; its quota is no longer reserved
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// archiveVersion copies a file's current content into its version history.
+// The blob reference held by the files row moves to the history row.
+func archiveVersion(tx *repository.Repository, file *models.File) error {
+	return tx.Versions.Create(context.Background(), &models.FileVersion{
+		ID:         uuid.New().String(),
+		FileID:     file.ID,
+		VersionNum: file.Version,
+		FilePath:   file.FilePath,
+		BlobID:     file.BlobID,
+		FileSize:   file.FileSize,
+		Checksum:   file.Checksum,
+		CreatedAt:  file.UpdatedAt,
+	})
+}
@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pk0205/dropbox-2.0/storage"
+)
+
+// maxRanges is the most ranges honoured in one request; larger range sets are
+// ignored and the whole content is sent instead (RFC 7233 section 3.1)
+const maxRanges = 32
+
+// download is content served by serveDownload
+type download struct {
+	Key      string    // Storage key of the content
+	Size     int64     // Content length
+	Name     string    // File name offered to the client
+	Checksum string    // SHA-256 of the content, used as a strong ETag
+	ModTime  time.Time // When the content last changed, for Last-Modified
+
+	// Sent, if set, is called once with the response status and how many
+	// body bytes were sent, when sending finishes or stops
+	Sent func(status int, bytes int64)
+
+	// Claim, if set, is called once the request's preconditions have passed
+	// and before a GET sends the content from its first byte, as a 200 or a
+	// range starting at byte 0. Returning false means it has written and
+	// recorded a refusal itself; serveDownload then returns its error.
+	Claim func() (bool, error)
+}
+
+// countingReader passes reads through while counting them and reports the
+// count to done once, when it is closed
+type countingReader struct {
+	r    io.Reader
+	n    int64
+	done func(int64)
+	once sync.Once
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) Close() error {
+	var err error
+	if closer, ok := cr.r.(io.Closer); ok {
+		err = closer.Close()
+	}
+	cr.once.Do(func() { cr.done(cr.n) })
+	return err
+}
+
+// reportSent wraps a response body with the given status so sent learns
+// how much of it went out. The server closes body streams once the
+// response is over, whether or not it was sent in full.
+func reportSent(r io.Reader, status int, sent func(int, int64)) io.Reader {
+	if sent == nil {
+		return r
+	}
+	return &countingReader{r: r, done: func(n int64) { sent(status, n) }}
+}
+
+// byteRange is a satisfiable range of a download
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// serveDownload sends d with validators, conditional request handling
+// (RFC 7232) and byte ranges, single or multipart/byteranges (RFC 7233).
+// Every download path goes through it so they behave the same.
+func serveDownload(c *fiber.Ctx, store storage.Backend, d download) error {
+	etag := ""
+	if d.Checksum != "" {
+		etag = `"` + d.Checksum + `"`
+		c.Set("ETag", etag)
+	}
+	modTime := d.ModTime.UTC().Truncate(time.Second)
+	if !modTime.IsZero() {
+		c.Set("Last-Modified", modTime.Format(http.TimeFormat))
+	}
+	c.Set("Accept-Ranges", "bytes")
+
+	// Only the paths that send content hand their body to d.Sent
+	sending := false
+	if d.Sent != nil {
+		defer func() {
+			if !sending {
+				d.Sent(c.Response().StatusCode(), 0)
+			}
+		}()
+	}
+
+	switch checkPreconditions(c, etag, modTime) {
+	case 304:
+		return c.SendStatus(304)
+	case 412:
+		return c.Status(412).JSON(fiber.Map{"error": "Precondition failed"})
+	}
+
+	c.Set("Content-Disposition", attachment(d.Name))
+
+	// A range only applies to the representation the client already has part of
+	var ranges []byteRange
+	if header := c.Get("Range"); header != "" && c.Method() == fiber.MethodGet && ifRangeMatches(c, etag, modTime) {
+		var ok bool
+		ranges, ok = parseRange(header, d.Size)
+		if !ok {
+			c.Set("Content-Range", fmt.Sprintf("bytes */%d", d.Size))
+			return c.Status(416).JSON(fiber.Map{"error": "Range not satisfiable"})
+		}
+	}
+
+	// Revalidations, failed preconditions and resumed downloads aren't claimed
+	if d.Claim != nil && c.Method() == fiber.MethodGet &&
+		(ranges == nil || slices.ContainsFunc(ranges, func(r byteRange) bool { return r.start == 0 })) {
+		if ok, err := d.Claim(); !ok {
+			sending = true // Not reported to d.Sent a second time
+			return err
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		reader, err := store.Get(context.Background(), d.Key)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to open file"})
+		}
+		c.Set("Content-Type", "application/octet-stream")
+		sending = true
+		return c.SendStream(reportSent(reader, 200, d.Sent), int(d.Size))
+
+	case 1:
+		r := ranges[0]
+		reader, err := store.GetRange(context.Background(), d.Key, r.start, r.length)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to open file"})
+		}
+		c.Set("Content-Type", "application/octet-stream")
+		c.Set("Content-Range", r.contentRange(d.Size))
+		sending = true
+		return c.Status(206).SendStream(reportSent(reader, 206, d.Sent), int(r.length))
+	}
+
+	// Several ranges go out as multipart/byteranges, each part read from
+	// storage only when the previous one has been sent
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		for _, r := range ranges {
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":  {"application/octet-stream"},
+				"Content-Range": {r.contentRange(d.Size)},
+			})
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			reader, err := store.GetRange(context.Background(), d.Key, r.start, r.length)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(part, reader)
+			reader.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+
+	c.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	sending = true
+	return c.Status(206).SendStream(reportSent(pr, 206, d.Sent))
+}
+
+// checkPreconditions evaluates the conditional request headers in the order
+// RFC 7232 section 6 gives, returning 304, 412 or 0 to carry on. Dates are
+// ignored when the modification time is unknown.
+func checkPreconditions(c *fiber.Ctx, etag string, modTime time.Time) int {
+	known := !modTime.IsZero()
+	if header := c.Get("If-Match"); header != "" {
+		if !etagMatches(header, etag, false) {
+			return 412
+		}
+	} else if t, err := http.ParseTime(c.Get("If-Unmodified-Since")); err == nil && known && modTime.After(t) {
+		return 412
+	}
+
+	safe := c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead
+	if header := c.Get("If-None-Match"); header != "" {
+		if etagMatches(header, etag, true) {
+			if safe {
+				return 304
+			}
+			return 412
+		}
+	} else if t, err := http.ParseTime(c.Get("If-Modified-Since")); err == nil && known && safe && !modTime.After(t) {
+		return 304
+	}
+	return 0
+}
+
+// ifRangeMatches reports whether a Range header should be honoured given
+// If-Range: only when the validator still matches the current content
+func ifRangeMatches(c *fiber.Ctx, etag string, modTime time.Time) bool {
+	header := strings.TrimSpace(c.Get("If-Range"))
+	if header == "" {
+		return true
+	}
+	if strings.HasPrefix(header, `"`) || strings.HasPrefix(header, "W/") {
+		return etag != "" && header == etag // Strong comparison only
+	}
+	t, err := http.ParseTime(header)
+	return err == nil && !modTime.IsZero() && t.Equal(modTime)
+}
+
+// etagMatches reports whether etag is in an If-Match or If-None-Match list.
+// "*" matches any current representation; weak comparison ignores W/.
+func etagMatches(header, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// attachment is the Content-Disposition of a download saved as name, quoted
+// or RFC 2231 encoded as the name needs so it can't break out of the header
+func attachment(name string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": name})
+}
+
+// parseRange parses a Range header against content of size bytes. It returns
+// the satisfiable ranges, none if the header should be ignored (wrong unit,
+// bad syntax or too many ranges), and false when no range is satisfiable.
+func parseRange(header string, size int64) ([]byteRange, bool) {
+	specs, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, true
+	}
+	list := strings.Split(specs, ",")
+	if len(list) > maxRanges {
+		return nil, true
+	}
+
+	var ranges []byteRange
+	for _, spec := range list {
+		spec = strings.TrimSpace(spec)
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, true
+		}
+
+		if first == "" {
+			// Suffix range: the final n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, true
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			ranges = append(ranges, byteRange{start: size - n, length: n})
+			continue
+		}
+
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, true
+		}
+		end := size - 1
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return nil, true
+			}
+			end = min(end, size-1)
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+
+	if len(ranges) == 0 {
+		return nil, false
+	}
+	return ranges, true
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pk0205/dropbox-2.0/storage"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		size   int64
+		want   []byteRange
+		ok     bool
+	}{
+		{"whole", "bytes=0-", 100, []byteRange{{0, 100}}, true},
+		{"closed", "bytes=10-19", 100, []byteRange{{10, 10}}, true},
+		{"end past size", "bytes=90-200", 100, []byteRange{{90, 10}}, true},
+		{"suffix", "bytes=-10", 100, []byteRange{{90, 10}}, true},
+		{"suffix past size", "bytes=-500", 100, []byteRange{{0, 100}}, true},
+		{"multiple", "bytes=0-9, 50-59", 100, []byteRange{{0, 10}, {50, 10}}, true},
+		{"unsatisfiable dropped", "bytes=0-9,200-300", 100, []byteRange{{0, 10}}, true},
+		{"start past size", "bytes=100-", 100, nil, false},
+		{"zero suffix", "bytes=-0", 100, nil, false},
+		{"empty content", "bytes=0-", 0, nil, false},
+		{"other unit", "items=0-9", 100, nil, true},
+		{"no dash", "bytes=10", 100, nil, true},
+		{"end before start", "bytes=20-10", 100, nil, true},
+		{"negative start", "bytes=-5-10", 100, nil, true},
+		{"not a number", "bytes=a-b", 100, nil, true},
+		{"too many", "bytes=0-0" + strings.Repeat(",0-0", maxRanges), 100, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRange(tt.header, tt.size)
+			if !reflect.DeepEqual(got, tt.want) || ok != tt.ok {
+				t.Errorf("parseRange(%q, %d) = %v, %v; want %v, %v", tt.header, tt.size, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	const etag = `"abc"`
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	before := modTime.Add(-time.Hour).Format(http.TimeFormat)
+	at := modTime.Format(http.TimeFormat)
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		modTime time.Time
+		want    int
+	}{
+		{"no conditions", "GET", nil, modTime, 0},
+		{"if-match hit", "GET", map[string]string{"If-Match": `"x", "abc"`}, modTime, 0},
+		{"if-match star", "GET", map[string]string{"If-Match": "*"}, modTime, 0},
+		{"if-match miss", "GET", map[string]string{"If-Match": `"x"`}, modTime, 412},
+		{"if-match weak", "GET", map[string]string{"If-Match": `W/"abc"`}, modTime, 412},
+		{"unmodified since before", "GET", map[string]string{"If-Unmodified-Since": before}, modTime, 412},
+		{"unmodified since at", "GET", map[string]string{"If-Unmodified-Since": at}, modTime, 0},
+		{"unmodified since unknown time", "GET", map[string]string{"If-Unmodified-Since": before}, time.Time{}, 0},
+		{"if-match wins over date", "GET", map[string]string{"If-Match": etag, "If-Unmodified-Since": before}, modTime, 0},
+		{"none-match hit", "GET", map[string]string{"If-None-Match": etag}, modTime, 304},
+		{"none-match weak hit", "HEAD", map[string]string{"If-None-Match": `W/"abc"`}, modTime, 304},
+		{"none-match miss", "GET", map[string]string{"If-None-Match": `"x"`}, modTime, 0},
+		{"none-match unsafe", "POST", map[string]string{"If-None-Match": etag}, modTime, 412},
+		{"modified since at", "GET", map[string]string{"If-Modified-Since": at}, modTime, 304},
+		{"modified since before", "GET", map[string]string{"If-Modified-Since": before}, modTime, 0},
+		{"modified since unsafe", "POST", map[string]string{"If-Modified-Since": at}, modTime, 0},
+		{"none-match wins over date", "GET", map[string]string{"If-None-Match": `"x"`, "If-Modified-Since": at}, modTime, 0},
+		{"if-match before none-match", "GET", map[string]string{"If-Match": `"x"`, "If-None-Match": etag}, modTime, 412},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got int
+			app := fiber.New()
+			app.All("/", func(c *fiber.Ctx) error {
+				got = checkPreconditions(c, etag, tt.modTime)
+				return nil
+			})
+
+			req := httptest.NewRequest(tt.method, "/", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if _, err := app.Test(req); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("checkPreconditions = %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachment(t *testing.T) {
+	for _, name := range []string{
+		"report.pdf",
+		"my report.pdf",
+		`quote".txt`,
+		"résumé.pdf",
+		"evil\r\nSet-Cookie: x=1",
+	} {
+		header := attachment(name)
+		disposition, params, err := mime.ParseMediaType(header)
+		if err != nil || disposition != "attachment" {
+			t.Errorf("attachment(%q) = %q: %v", name, header, err)
+			continue
+		}
+		if params["filename"] != name {
+			t.Errorf("attachment(%q) = %q, parses as %q", name, header, params["filename"])
+		}
+	}
+}
+
+func TestServeDownloadClaims(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put(context.Background(), "content", strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	const etag = `"abc"`
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		refuse  bool
+		status  int
+		claimed bool
+	}{
+		{"full", "GET", nil, false, 200, true},
+		{"head", "HEAD", nil, false, 200, false},
+		{"range from start", "GET", map[string]string{"Range": "bytes=0-4"}, false, 206, true},
+		{"resumed range", "GET", map[string]string{"Range": "bytes=5-"}, false, 206, false},
+		{"multipart with start", "GET", map[string]string{"Range": "bytes=6-7,0-1"}, false, 206, true},
+		{"suffix range", "GET", map[string]string{"Range": "bytes=-3"}, false, 206, false},
+		{"stale if-range", "GET", map[string]string{"Range": "bytes=5-", "If-Range": `"old"`}, false, 200, true},
+		{"not modified", "GET", map[string]string{"If-None-Match": etag}, false, 304, false},
+		{"precondition failed", "GET", map[string]string{"If-Match": `"old"`}, false, 412, false},
+		{"unsatisfiable", "GET", map[string]string{"Range": "bytes=50-"}, false, 416, false},
+		{"refused", "GET", nil, true, 410, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claimed, reported := false, 0
+			app := fiber.New()
+			app.All("/", func(c *fiber.Ctx) error {
+				return serveDownload(c, store, download{
+					Key: "content", Size: 10, Name: "file.txt", Checksum: "abc", ModTime: modTime,
+					Sent: func(int, int64) { reported++ },
+					Claim: func() (bool, error) {
+						claimed = true
+						if tt.refuse {
+							return false, c.Status(410).JSON(fiber.Map{"error": "limit reached"})
+						}
+						return true, nil
+					},
+				})
+			})
+
+			req := httptest.NewRequest(tt.method, "/", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status || claimed != tt.claimed {
+				t.Errorf("status %d, claimed %v; want %d, %v", resp.StatusCode, claimed, tt.status, tt.claimed)
+			}
+			// A refusal is recorded by Claim, everything else through Sent
+			want := 1
+			if tt.refuse {
+				want = 0
+			}
+			if reported != want {
+				t.Errorf("Sent called %d times; want %d", reported, want)
+			}
+		})
+	}
+}
@@ -1,15 +1,22 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
 	"mime/multipart"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,17 +24,39 @@ import (
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/pk0205/dropbox-2.0/models"
+	"github.com/pk0205/dropbox-2.0/repository"
+	"github.com/pk0205/dropbox-2.0/storage"
 )
 
 const (
-	UploadDir  = "./uploads"         // Simple uploads directory
-	StorageDir = "./storage"         // Advanced storage with user directories
-	ChunkSize  = 5 * 1024 * 1024     // 5MB chunks
-	MaxWorkers = 10                  // Parallel workers for processing
+	UploadDir  = "./uploads"     // Simple uploads directory
+	StorageDir = "./storage"     // Advanced storage with user directories
+	ChunkSize  = 5 * 1024 * 1024 // 5MB chunks
+	MaxWorkers = 10              // Parallel workers for processing
+
+	MaxUploadExtendHours = 7 * 24 // Longest an upload session can be extended by at once
+
+	DefaultParallelUploadMax = 10 * 1024 * 1024 * 1024 // Most bytes of files one parallel upload can send, by default
 )
 
+// errUploadTooLarge is returned when a parallel upload sends more file bytes
+// than it is allowed to
+var errUploadTooLarge = errors.New("upload is too large")
+
+// objectKey maps a files.file_path value to its key in the storage backend.
+// Rows written before the backend existed hold paths like storage/users/...,
+// newer rows hold the key itself.
+func objectKey(filePath string) string {
+	return storage.PathKey(filePath, StorageDir)
+}
+
+// chunkKey returns the storage key of one chunk of an upload session
+func chunkKey(uploadID string, chunkNum int) string {
+	return path.Join("chunks", uploadID, fmt.Sprintf("chunk_%d", chunkNum))
+}
+
 // UploadFile handles basic file uploads (for small files < 10MB)
-func UploadFile() fiber.Handler {
+func UploadFile(uploads storage.Backend) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		// Parse the uploaded file
 		file, err := c.FormFile("file")
@@ -43,14 +72,14 @@ func UploadFile() fiber.Handler {
 		// Generate a unique file name
 		uniqueFileName := uuid.New().String() + filepath.Ext(file.Filename)
 
-		// Ensure the upload directory exists
-		if err := os.MkdirAll(UploadDir, os.ModePerm); err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to create upload directory"})
+		// Save the file to the storage backend
+		src, err := file.Open()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to save file: " + err.Error()})
 		}
+		defer src.Close()
 
-		// Save the file to the server
-		filePath := filepath.Join(UploadDir, uniqueFileName)
-		if err := c.SaveFile(file, filePath); err != nil {
+		if _, err := uploads.Put(context.Background(), uniqueFileName, src); err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to save file: " + err.Error()})
 		}
 
@@ -63,54 +92,85 @@ func UploadFile() fiber.Handler {
 }
 
 // DownloadFile handles basic file downloads
-func DownloadFile() fiber.Handler {
+func DownloadFile(uploads storage.Backend) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		// Get the file name from the URL parameter
 		fileName := c.Params("fileName")
 
-		// Construct the file path
-		filePath := filepath.Join(UploadDir, fileName)
-
 		// Check if the file exists
-		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		info, err := uploads.Stat(context.Background(), fileName)
+		if err != nil {
 			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
 		}
 
+		reader, err := uploads.Get(context.Background(), fileName)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to open file"})
+		}
+
 		// Set the appropriate headers for file download
 		c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
 		c.Set("Content-Type", "application/octet-stream")
 
 		// Send the file
-		return c.SendFile(filePath)
+		return c.SendStream(reader, int(info.Size))
 	}
 }
 
 // ChunkedUploadInit initializes a chunked upload session
-func ChunkedUploadInit(conn *pgx.Conn) fiber.Handler {
+func ChunkedUploadInit(repo *repository.Repository) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		req := struct {
 			FileName    string `json:"fileName"`
 			TotalSize   int64  `json:"totalSize"`
 			TotalChunks int    `json:"totalChunks"`
 			ParentID    string `json:"parentId"`
+			FileID      string `json:"fileId"`     // Upload a new version of this file
+			Checksum    string `json:"checksum"`   // SHA-256 of the whole file, verified on completion
+			OnConflict  string `json:"onConflict"` // rename, version or reject
 		}{}
 
 		if err := c.BodyParser(&req); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 		}
+		req.Checksum = strings.ToLower(req.Checksum)
+		if msg := checkChunkedInit(req.TotalSize, req.TotalChunks, req.Checksum); msg != "" {
+			return c.Status(400).JSON(fiber.Map{"error": msg})
+		}
 
 		// Get user ID from context (set by auth middleware)
 		userID := c.Locals("userID").(string)
 
+		target, err := newUploadTarget(repo, userID, req.FileID, req.ParentID, req.FileName, req.OnConflict)
+		if status, msg := uploadErrorStatus(err); status != 0 {
+			return c.Status(status).JSON(fiber.Map{"error": msg})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to initialize upload"})
+		}
+
 		uploadID := uuid.New().String()
 		expiresAt := time.Now().Add(24 * time.Hour)
 
-		// Store upload session in database
-		_, err := conn.Exec(context.Background(),
-			`INSERT INTO chunk_uploads (id, user_id, file_name, total_chunks, chunk_size, total_size, status, created_at, expires_at)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
-			uploadID, userID, req.FileName, req.TotalChunks, ChunkSize, req.TotalSize, "pending", time.Now(), expiresAt)
+		// Store upload session in database; it reserves totalSize of the
+		// folder owner's quota, which completion charges, until it
+		// completes or expires
+		err = repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+			if err := checkQuota(tx, target.UserID, req.TotalSize, ""); err != nil {
+				return err
+			}
+			return tx.Uploads.Create(context.Background(), newUploadSession(uploadID, userID, target, "chunked", &models.ChunkUpload{
+				TotalChunks:      req.TotalChunks,
+				ChunkSize:        ChunkSize,
+				TotalSize:        req.TotalSize,
+				ExpectedChecksum: req.Checksum,
+				ExpiresAt:        expiresAt,
+			}))
+		})
 
+		if err == errQuotaExceeded {
+			return quotaExceeded(c)
+		}
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to initialize upload"})
 		}
@@ -124,217 +184,596 @@ func ChunkedUploadInit(conn *pgx.Conn) fiber.Handler {
 	}
 }
 
-// ChunkedUploadChunk handles individual chunk uploads with parallel processing
-func ChunkedUploadChunk(conn *pgx.Conn) fiber.Handler {
+// checkChunkedInit validates the size, chunk count and optional lower case
+// checksum a chunked session is started with, returning what is wrong or ""
+func checkChunkedInit(totalSize int64, totalChunks int, checksum string) string {
+	if totalSize <= 0 {
+		return "totalSize must be positive"
+	}
+	if expected := int((totalSize + ChunkSize - 1) / ChunkSize); totalChunks != expected {
+		return fmt.Sprintf("totalChunks must be %d for %d byte chunks", expected, ChunkSize)
+	}
+	if checksum != "" && !isSHA256Hex(checksum) {
+		return "checksum must be a hex SHA-256"
+	}
+	return ""
+}
+
+// ChunkedUploadChunk handles individual chunk uploads with parallel processing.
+// Clients may send the chunk's SHA-256 (checksum) or CRC32C (crc32c, hex) to
+// have it verified; sending the same chunk again is harmless.
+func ChunkedUploadChunk(repo *repository.Repository, store storage.Backend) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		uploadID := c.Params("uploadId")
-		chunkNum, err := strconv.Atoi(c.FormValue("chunkNumber"))
-		if err != nil {
-			return c.Status(400).JSON(fiber.Map{"error": "Invalid chunk number"})
-		}
-
-		// Get file from form
-		fileHeader, err := c.FormFile("chunk")
-		if err != nil {
-			return c.Status(400).JSON(fiber.Map{"error": "Failed to get chunk"})
-		}
 
 		// Get user ID from context
 		userID := c.Locals("userID").(string)
 
 		// Verify upload session exists and belongs to user
-		var fileName string
-		var totalChunks int
-		err = conn.QueryRow(context.Background(),
-			`SELECT file_name, total_chunks FROM chunk_uploads 
-			WHERE id=$1 AND user_id=$2 AND status='pending' AND expires_at > NOW()`,
-			uploadID, userID).Scan(&fileName, &totalChunks)
-
-		if err != nil {
+		upload, err := repo.Uploads.GetActive(context.Background(), uploadID, userID)
+		if err != nil || upload.Protocol != "chunked" {
 			return c.Status(404).JSON(fiber.Map{"error": "Upload session not found or expired"})
 		}
 
-		// Create temp directory for chunks
-		chunkDir := filepath.Join(StorageDir, "chunks", uploadID)
-		if err := os.MkdirAll(chunkDir, os.ModePerm); err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to create chunk directory"})
-		}
+		return receiveChunk(c, repo, store, upload)
+	}
+}
 
-		// Save chunk
-		chunkPath := filepath.Join(chunkDir, fmt.Sprintf("chunk_%d", chunkNum))
-		if err := c.SaveFile(fileHeader, chunkPath); err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to save chunk"})
-		}
+// receiveChunk stores the chunk sent in the request for an active chunked
+// session, verifying its length and any checksum the client sent
+func receiveChunk(c *fiber.Ctx, repo *repository.Repository, store storage.Backend, upload *models.ChunkUpload) error {
+	uploadID := upload.ID
+	chunkNum, err := strconv.Atoi(c.FormValue("chunkNumber"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid chunk number"})
+	}
 
-		// Update uploaded chunks in database
-		_, err = conn.Exec(context.Background(),
-			`UPDATE chunk_uploads SET uploaded_chunks = array_append(uploaded_chunks, $1), status='uploading'
-			WHERE id=$2`,
-			chunkNum, uploadID)
+	// Get file from form
+	fileHeader, err := c.FormFile("chunk")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Failed to get chunk"})
+	}
 
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to update upload progress"})
+	// Every chunk but the last is exactly chunkSize bytes
+	if chunkNum < 0 || chunkNum >= upload.TotalChunks {
+		return c.Status(400).JSON(fiber.Map{
+			"error": fmt.Sprintf("chunkNumber must be between 0 and %d", upload.TotalChunks-1),
+		})
+	}
+	if expected := chunkLength(upload, chunkNum); fileHeader.Size != expected {
+		return c.Status(400).JSON(fiber.Map{
+			"error": fmt.Sprintf("chunk %d must be %d bytes, got %d", chunkNum, expected, fileHeader.Size),
+		})
+	}
+
+	// Hash the chunk before storing it
+	chunk, err := fileHeader.Open()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to save chunk"})
+	}
+	defer chunk.Close()
+
+	sha := sha256.New()
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err := io.Copy(io.MultiWriter(sha, crc), chunk); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to read chunk"})
+	}
+	checksum := hex.EncodeToString(sha.Sum(nil))
+
+	if want := strings.ToLower(c.FormValue("checksum")); want != "" && want != checksum {
+		return c.Status(422).JSON(fiber.Map{"error": "Chunk checksum mismatch", "chunkNumber": chunkNum})
+	}
+	if want := strings.ToLower(c.FormValue("crc32c")); want != "" && want != hex.EncodeToString(crc.Sum(nil)) {
+		return c.Status(422).JSON(fiber.Map{"error": "Chunk checksum mismatch", "chunkNumber": chunkNum})
+	}
+	if _, err := chunk.Seek(0, io.SeekStart); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to save chunk"})
+	}
+
+	duplicate := false
+	err = repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+		// Concurrent sends of the same chunk take turns
+		if err := tx.Uploads.LockChunk(context.Background(), uploadID, chunkNum); err != nil {
+			return err
 		}
 
-		return c.Status(200).JSON(fiber.Map{
-			"message":     "Chunk uploaded successfully",
-			"chunkNumber": chunkNum,
+		existing, err := tx.Uploads.GetPart(context.Background(), uploadID, chunkNum)
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+		if existing != nil && existing.Checksum == checksum {
+			duplicate = true
+			return nil
+		}
+
+		if _, err := store.Put(context.Background(), chunkKey(uploadID, chunkNum), chunk); err != nil {
+			return err
+		}
+		return tx.Uploads.SavePart(context.Background(), &models.ChunkPart{
+			UploadID:    uploadID,
+			ChunkNumber: chunkNum,
+			Size:        fileHeader.Size,
+			Checksum:    checksum,
+			CreatedAt:   time.Now(),
 		})
+	})
+
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to save chunk"})
 	}
+
+	return c.Status(200).JSON(fiber.Map{
+		"message":     "Chunk uploaded successfully",
+		"chunkNumber": chunkNum,
+		"checksum":    checksum,
+		"duplicate":   duplicate,
+	})
 }
 
-// ChunkedUploadComplete finalizes the upload by combining chunks in parallel
-func ChunkedUploadComplete(conn *pgx.Conn) fiber.Handler {
+// ChunkedUploadStatus reports what the server has received for an upload
+// session, so an interrupted client can upload only the missing chunks
+func ChunkedUploadStatus(repo *repository.Repository) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		uploadID := c.Params("uploadId")
 		userID := c.Locals("userID").(string)
 
-		// Get upload session
-		var fileName string
-		var totalChunks int
-		var totalSize int64
-		err := conn.QueryRow(context.Background(),
-			`SELECT file_name, total_chunks, total_size FROM chunk_uploads 
-			WHERE id=$1 AND user_id=$2`,
-			uploadID, userID).Scan(&fileName, &totalChunks, &totalSize)
-
+		upload, err := repo.Uploads.Get(context.Background(), uploadID, userID)
 		if err != nil {
 			return c.Status(404).JSON(fiber.Map{"error": "Upload session not found"})
 		}
 
-		chunkDir := filepath.Join(StorageDir, "chunks", uploadID)
+		return c.Status(200).JSON(uploadStatus(upload))
+	}
+}
 
-		// Create final file
-		fileID := uuid.New().String()
-		userDir := filepath.Join(StorageDir, "users", userID)
-		if err := os.MkdirAll(userDir, os.ModePerm); err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to create user directory"})
-		}
+// uploadStatus describes a session's progress for ChunkedUploadStatus
+func uploadStatus(upload *models.ChunkUpload) fiber.Map {
+	type chunkRange struct {
+		Start int `json:"start"`
+		End   int `json:"end"` // Inclusive
+	}
 
-		finalPath := filepath.Join(userDir, fileID+filepath.Ext(fileName))
-		finalFile, err := os.Create(finalPath)
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to create final file"})
+	// Received chunk numbers, sorted and without repeats
+	received := []int{}
+	have := make(map[int]bool, len(upload.UploadedChunks))
+	for _, n := range upload.UploadedChunks {
+		if !have[n] {
+			have[n] = true
+			received = append(received, n)
 		}
-		defer finalFile.Close()
-
-		// Combine chunks in order (parallelized reading)
-		hash := sha256.New()
-		for i := 0; i < totalChunks; i++ {
-			chunkPath := filepath.Join(chunkDir, fmt.Sprintf("chunk_%d", i))
-			chunkData, err := os.ReadFile(chunkPath)
-			if err != nil {
-				return c.Status(500).JSON(fiber.Map{"error": fmt.Sprintf("Failed to read chunk %d", i)})
+	}
+	sort.Ints(received)
+
+	bytesReceived := upload.Offset
+	missing := []chunkRange{}
+	if upload.Protocol == "chunked" {
+		bytesReceived = 0
+		for _, n := range received {
+			bytesReceived += chunkLength(upload, n)
+		}
+		for n := 0; n < upload.TotalChunks; n++ {
+			if have[n] {
+				continue
 			}
-
-			if _, err := finalFile.Write(chunkData); err != nil {
-				return c.Status(500).JSON(fiber.Map{"error": "Failed to write to final file"})
+			if len(missing) > 0 && missing[len(missing)-1].End == n-1 {
+				missing[len(missing)-1].End = n
+			} else {
+				missing = append(missing, chunkRange{Start: n, End: n})
 			}
-			hash.Write(chunkData)
 		}
+	}
 
-		checksum := hex.EncodeToString(hash.Sum(nil))
+	active := (upload.Status == "pending" || upload.Status == "uploading") && upload.ExpiresAt.After(time.Now())
+
+	return fiber.Map{
+		"uploadId":       upload.ID,
+		"fileName":       upload.FileName,
+		"protocol":       upload.Protocol,
+		"status":         upload.Status,
+		"active":         active,
+		"totalChunks":    upload.TotalChunks,
+		"chunkSize":      upload.ChunkSize,
+		"totalSize":      upload.TotalSize,
+		"receivedChunks": received,
+		"missingChunks":  missing,
+		"bytesReceived":  bytesReceived,
+		"fileId":         upload.FileID, // The resulting file once completed
+		"error":          upload.Error,
+		"createdAt":      upload.CreatedAt,
+		"expiresAt":      upload.ExpiresAt,
+	}
+}
 
-		// Save file metadata to database
-		_, err = conn.Exec(context.Background(),
-			`INSERT INTO files (id, user_id, file_name, original_name, file_path, file_size, checksum, is_folder, created_at, updated_at)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
-			fileID, userID, fileID+filepath.Ext(fileName), fileName, finalPath, totalSize, checksum, false, time.Now(), time.Now())
+// ChunkedUploadExtend pushes back the expiry of an active upload session
+func ChunkedUploadExtend(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		uploadID := c.Params("uploadId")
+		userID := c.Locals("userID").(string)
+
+		req := struct {
+			Hours int `json:"hours"` // From now, defaults to 24
+		}{}
+
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+			}
+		}
+		if req.Hours == 0 {
+			req.Hours = 24
+		}
+		if req.Hours < 1 || req.Hours > MaxUploadExtendHours {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("hours must be between 1 and %d", MaxUploadExtendHours)})
+		}
 
+		expiresAt := time.Now().Add(time.Duration(req.Hours) * time.Hour)
+		err := repo.Uploads.Extend(context.Background(), uploadID, userID, expiresAt)
+		if err == pgx.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Upload session not found or expired"})
+		}
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to save file metadata"})
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to extend upload"})
 		}
 
-		// Clean up chunks
-		os.RemoveAll(chunkDir)
+		return c.Status(200).JSON(fiber.Map{
+			"message":   "Upload session extended",
+			"uploadId":  uploadID,
+			"expiresAt": expiresAt,
+		})
+	}
+}
+
+// chunkLength is the size of chunk n of a chunked session; only the last
+// chunk may be shorter than chunkSize
+func chunkLength(upload *models.ChunkUpload, n int) int64 {
+	start := int64(n) * upload.ChunkSize
+	return max(min(upload.ChunkSize, upload.TotalSize-start), 0)
+}
 
-		// Update upload session status
-		conn.Exec(context.Background(),
-			`UPDATE chunk_uploads SET status='completed' WHERE id=$1`, uploadID)
+// ChunkedUploadComplete finalizes the upload by assembling its chunks. With
+// ?async=true it responds 202 straight away and the client polls the session
+// status until it is completed or failed.
+func ChunkedUploadComplete(repo *repository.Repository, store storage.Backend) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		uploadID := c.Params("uploadId")
+		userID := c.Locals("userID").(string)
+
+		// Get upload session (tus sessions complete through their own endpoint)
+		upload, err := repo.Uploads.GetActive(context.Background(), uploadID, userID)
+		if err != nil || upload.Protocol != "chunked" {
+			return c.Status(404).JSON(fiber.Map{"error": "Upload session not found"})
+		}
+
+		saved, err := completeUpload(c, repo, store, upload)
+		if saved == nil {
+			return err
+		}
 
 		return c.Status(200).JSON(fiber.Map{
 			"message":  "File uploaded successfully",
-			"fileId":   fileID,
-			"fileName": fileName,
-			"fileSize": totalSize,
-			"checksum": checksum,
+			"fileId":   saved.FileID,
+			"fileName": saved.FileName,
+			"fileSize": upload.TotalSize,
+			"mimeType": saved.MimeType,
+			"checksum": saved.Checksum,
+			"version":  saved.Version,
 		})
 	}
 }
 
-// StreamDownload provides streaming download with range support for resumable downloads
-func StreamDownload(conn *pgx.Conn) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		fileID := c.Params("fileId")
-		userID := c.Locals("userID").(string)
+// completeUpload assembles an active chunked session once every chunk has
+// arrived, or with ?async=true starts assembly and responds 202. When it
+// doesn't return the saved file it has written the response itself and
+// returns nil with the result of writing it.
+func completeUpload(c *fiber.Ctx, repo *repository.Repository, store storage.Backend, upload *models.ChunkUpload) (*savedUpload, error) {
+	uploadID := upload.ID
 
-		// Get file info
-		var filePath string
-		var fileName string
-		var fileSize int64
-		err := conn.QueryRow(context.Background(),
-			`SELECT file_path, original_name, file_size FROM files WHERE id=$1 AND user_id=$2`,
-			fileID, userID).Scan(&filePath, &fileName, &fileSize)
+	// Missing chunks can still be sent, so report them before assembly starts
+	parts, err := repo.Uploads.ListParts(context.Background(), uploadID)
+	if err != nil {
+		return nil, c.Status(500).JSON(fiber.Map{"error": "Failed to get upload progress"})
+	}
+	if missing := firstMissingChunk(parts, upload.TotalChunks); missing >= 0 {
+		return nil, c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("chunk %d is missing", missing)})
+	}
+
+	if err := repo.Uploads.StartAssembly(context.Background(), uploadID, upload.UserID); err == pgx.ErrNoRows {
+		return nil, c.Status(409).JSON(fiber.Map{"error": "Upload is already being assembled"})
+	} else if err != nil {
+		return nil, c.Status(500).JSON(fiber.Map{"error": "Failed to assemble upload"})
+	}
+
+	if c.QueryBool("async") {
+		go func() {
+			if _, err := finishUpload(repo, store, upload); err != nil {
+				log.Printf("upload %s: assembly failed: %v", uploadID, err)
+			}
+		}()
+		return nil, c.Status(202).JSON(fiber.Map{
+			"message":  "Upload is being assembled",
+			"uploadId": uploadID,
+			"status":   "assembling",
+		})
+	}
+
+	saved, err := finishUpload(repo, store, upload)
+	if status, msg := uploadErrorStatus(err); status != 0 {
+		return nil, c.Status(status).JSON(fiber.Map{"error": msg})
+	}
+	if errors.Is(err, errUploadIncomplete) {
+		return nil, c.Status(409).JSON(fiber.Map{"error": err.Error()})
+	}
+	if errors.Is(err, errUploadCorrupt) {
+		return nil, c.Status(422).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err == errUploadAbandoned {
+		return nil, c.Status(410).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return nil, c.Status(500).JSON(fiber.Map{"error": "Failed to assemble upload"})
+	}
+
+	return saved, nil
+}
 
+var (
+	errUploadIncomplete = errors.New("upload is incomplete")
+	errUploadCorrupt    = errors.New("upload is corrupt")
+	errUploadAbandoned  = errors.New("upload session expired during assembly")
+)
+
+// finishUpload assembles a session already moved to assembling and records
+// the result as a file. If that fails the session is marked failed, with the
+// reason when it is something the client can act on, and its chunks are
+// removed since a failed session can't be resumed.
+func finishUpload(repo *repository.Repository, store storage.Backend, upload *models.ChunkUpload) (*savedUpload, error) {
+	saved, err := assembleUpload(repo, store, upload)
+	if err != nil {
+		reason := "assembly failed"
+		if status, msg := uploadErrorStatus(err); status != 0 {
+			reason = msg
+		} else if errors.Is(err, errUploadIncomplete) || errors.Is(err, errUploadCorrupt) {
+			reason = err.Error()
+		}
+		repo.Uploads.Fail(context.Background(), upload.ID, reason)
+		storage.DeletePrefix(context.Background(), store, path.Join("chunks", upload.ID)+"/")
+	}
+	return saved, err
+}
+
+// assembleUpload streams a session's chunks in order into a temporary file,
+// checking them against what was received, stores the result as a blob and
+// records it as a file (or a new version), then removes the chunks
+func assembleUpload(repo *repository.Repository, store storage.Backend, upload *models.ChunkUpload) (*savedUpload, error) {
+	// Chunked sessions record every chunk; tus sessions only ever append
+	var parts []models.ChunkPart
+	if upload.Protocol == "chunked" {
+		var err error
+		parts, err = repo.Uploads.ListParts(context.Background(), upload.ID)
 		if err != nil {
-			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+			return nil, err
 		}
+		if missing := firstMissingChunk(parts, upload.TotalChunks); missing >= 0 {
+			return nil, fmt.Errorf("%w: chunk %d is missing", errUploadIncomplete, missing)
+		}
+	}
+
+	// Named after the session so the reaper can find it if assembly dies
+	assembled, err := storage.CreateTemp(store, "assemble-"+upload.ID+"-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(assembled.Name())
+	defer assembled.Close()
 
-		// Open file
-		file, err := os.Open(filePath)
+	hash := sha256.New()
+	var size int64
+	for i := 0; i < upload.TotalChunks; i++ {
+		chunk, err := store.Get(context.Background(), chunkKey(upload.ID, i))
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to open file"})
+			return nil, fmt.Errorf("chunk %d: %w", i, err)
 		}
-		defer file.Close()
+		chunkHash := sha256.New()
+		n, err := io.Copy(io.MultiWriter(assembled, hash, chunkHash), chunk)
+		chunk.Close()
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: %w", i, err)
+		}
+		size += n
 
-		// Support range requests for resumable downloads
-		rangeHeader := c.Get("Range")
-		if rangeHeader != "" {
-			// Parse range header (simplified - production should handle multiple ranges)
-			var start, end int64
-			fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end)
+		// Catch chunks damaged in storage since they were received
+		if parts != nil && hex.EncodeToString(chunkHash.Sum(nil)) != parts[i].Checksum {
+			return nil, fmt.Errorf("%w: chunk %d does not match its checksum", errUploadCorrupt, i)
+		}
+	}
 
-			if end == 0 || end >= fileSize {
-				end = fileSize - 1
-			}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if size != upload.TotalSize {
+		return nil, fmt.Errorf("%w: assembled %d bytes, expected %d", errUploadCorrupt, size, upload.TotalSize)
+	}
+	if upload.ExpectedChecksum != "" && checksum != upload.ExpectedChecksum {
+		return nil, fmt.Errorf("%w: checksum %s does not match %s", errUploadCorrupt, checksum, upload.ExpectedChecksum)
+	}
+
+	// Sniff the MIME type from the start of the file
+	head := make([]byte, 512)
+	n, err := assembled.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// Store the content under its checksum, sharing any identical blob
+	if err := assembled.Close(); err != nil {
+		return nil, err
+	}
+	if err := storeBlobFile(repo, store, checksum, assembled.Name()); err != nil {
+		return nil, err
+	}
+
+	// Save file metadata to database where the session asked for it,
+	// checking again that the uploader may still write there
+	var fileID, parentID string
+	if upload.FileID != nil {
+		fileID = *upload.FileID
+	}
+	if upload.ParentID != nil {
+		parentID = *upload.ParentID
+	}
+	target, err := newUploadTarget(repo, upload.UserID, fileID, parentID, upload.FileName, upload.OnConflict)
+	if err != nil {
+		return nil, err
+	}
+	target.MimeType = sniffMimeType(head[:n], upload.FileName)
+	target.UploadID = upload.ID
+	saved, err := saveUploadedContent(repo, *target, size, checksum)
+	if err != nil {
+		return nil, err
+	}
 
-			// Seek to start position
-			file.Seek(start, 0)
+	// Clean up chunks
+	storage.DeletePrefix(context.Background(), store, path.Join("chunks", upload.ID)+"/")
+
+	return saved, nil
+}
 
-			c.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
-			c.Set("Content-Length", fmt.Sprintf("%d", end-start+1))
-			c.Status(206) // Partial Content
-		} else {
-			c.Set("Content-Length", fmt.Sprintf("%d", fileSize))
+// newUploadSession fills in a new session of the uploader userID for target
+// from the protocol-specific fields of session
+func newUploadSession(uploadID, userID string, target *uploadTarget, protocol string, session *models.ChunkUpload) *models.ChunkUpload {
+	session.ID = uploadID
+	session.UserID = userID
+	session.OwnerID = target.UserID
+	session.FileName = target.OriginalName
+	session.ParentID = target.ParentID
+	session.OnConflict = target.OnConflict
+	session.Protocol = protocol
+	session.Status = "pending"
+	session.CreatedAt = time.Now()
+	if target.FileID != "" {
+		session.FileID = &target.FileID
+	}
+	return session
+}
+
+// firstMissingChunk returns the lowest chunk number below total that hasn't
+// been received, or -1. parts must be ordered by chunk number.
+func firstMissingChunk(parts []models.ChunkPart, total int) int {
+	for i := 0; i < total; i++ {
+		if i >= len(parts) || parts[i].ChunkNumber != i {
+			return i
 		}
+	}
+	return -1
+}
 
-		c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
-		c.Set("Content-Type", "application/octet-stream")
-		c.Set("Accept-Ranges", "bytes")
+// StreamDownload streams a file with range and conditional request support
+// for resumable downloads
+func StreamDownload(repo *repository.Repository, store storage.Backend) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fileID := c.Params("fileId")
+		userID := c.Locals("userID").(string)
 
-		return c.SendStream(file)
+		// Get file info
+		file, _, err := accessibleFile(repo, fileID, userID, models.RoleViewer)
+		if err != nil || file.IsFolder {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+		}
+
+		return serveDownload(c, store, fileDownload(file))
+	}
+}
+
+// fileDownload describes the current content of a file for serveDownload
+func fileDownload(file *models.File) download {
+	return download{
+		Key:      contentKey(file.BlobID, file.FilePath),
+		Size:     file.FileSize,
+		Name:     file.OriginalName,
+		Checksum: file.Checksum,
+		ModTime:  file.UpdatedAt,
 	}
 }
 
-// ParallelUpload handles parallel upload of multiple files
-func ParallelUpload(conn *pgx.Conn) fiber.Handler {
+// ParallelUpload handles parallel upload of multiple files. The route is
+// exempt from the body limit, so the files are capped at maxBytes in total
+// while they are read.
+func ParallelUpload(repo *repository.Repository, store storage.Backend, maxBytes int64) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		userID := c.Locals("userID").(string)
 
-		form, err := c.MultipartForm()
-		if err != nil {
+		// Read the body part by part instead of buffering the whole form, so
+		// memory use stays flat however large the files are
+		boundary := string(c.Request().Header.MultipartFormBoundary())
+		if boundary == "" {
 			return c.Status(400).JSON(fiber.Map{"error": "Failed to parse form"})
 		}
+		body := c.Context().RequestBodyStream()
+		if body == nil {
+			body = bytes.NewReader(c.Body())
+		}
 
-		files := form.File["files"]
+		files, values, err := spoolMultipart(store, body, boundary, maxBytes)
+		defer func() {
+			for _, f := range files {
+				os.Remove(f.Path) // Already gone unless the file wasn't stored
+			}
+		}()
+		if err == errUploadTooLarge {
+			c.Context().SetConnectionClose() // The rest of the body is left unread
+			return c.Status(413).JSON(fiber.Map{
+				"error": fmt.Sprintf("Files in one upload can't exceed %d bytes", maxBytes),
+			})
+		}
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to save upload"})
+		}
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Failed to parse form"})
+		}
 		if len(files) == 0 {
 			return c.Status(400).JSON(fiber.Map{"error": "No files provided"})
 		}
 
+		// An explicit fileId uploads a new version of that file; otherwise
+		// files land in parentId, with onConflict deciding what happens to
+		// names that are already taken
+		targetFileID := values["fileId"]
+		if targetFileID != "" && len(files) > 1 {
+			return c.Status(400).JSON(fiber.Map{"error": "fileId can only be used with a single file"})
+		}
+		parentID := values["parentId"]
+		onConflict := values["onConflict"]
+		if _, ok := uploadConflictPolicy(onConflict); !ok {
+			return c.Status(400).JSON(fiber.Map{"error": "onConflict must be rename, version or reject"})
+		}
+		// The batch is charged to whoever owns the destination, which for a
+		// shared folder or file is not the uploader
+		ownerID, err := uploadOwner(repo, userID, targetFileID, parentID, onConflict)
+		if status, msg := uploadErrorStatus(err); status != 0 {
+			return c.Status(status).JSON(fiber.Map{"error": msg})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to check destination"})
+		}
+
+		// Fail fast when the batch can't fit; each file is checked again
+		// atomically as it is saved
+		var batchSize int64
+		for _, f := range files {
+			batchSize += f.Size
+		}
+		if err := checkQuota(repo, ownerID, batchSize, ""); err == errQuotaExceeded {
+			return quotaExceeded(c)
+		} else if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to check quota"})
+		}
+
 		// Use worker pool for parallel processing
 		type result struct {
 			FileID   string `json:"fileId"`
 			FileName string `json:"fileName"`
+			MimeType string `json:"mimeType,omitempty"`
+			Version  int    `json:"version,omitempty"`
 			Error    string `json:"error,omitempty"`
 		}
 
@@ -342,20 +781,28 @@ func ParallelUpload(conn *pgx.Conn) fiber.Handler {
 		var wg sync.WaitGroup
 		semaphore := make(chan struct{}, MaxWorkers)
 
-		for i, fileHeader := range files {
+		for i, file := range files {
 			wg.Add(1)
-			go func(idx int, fh *multipart.FileHeader) {
+			go func(idx int, f *spooledFile) {
 				defer wg.Done()
 				semaphore <- struct{}{}        // Acquire
 				defer func() { <-semaphore }() // Release
 
-				fileID, err := saveFileWithDeduplication(conn, userID, fh)
+				target, err := newUploadTarget(repo, userID, targetFileID, parentID, f.Name, onConflict)
+				var saved *savedUpload
+				if err == nil {
+					saved, err = saveFileWithDeduplication(repo, store, *target, f)
+				}
 				if err != nil {
-					results[idx] = result{Error: err.Error(), FileName: fh.Filename}
+					if _, msg := uploadErrorStatus(err); msg != "" {
+						results[idx] = result{Error: msg, FileName: f.Name}
+					} else {
+						results[idx] = result{Error: err.Error(), FileName: f.Name}
+					}
 				} else {
-					results[idx] = result{FileID: fileID, FileName: fh.Filename}
+					results[idx] = result{FileID: saved.FileID, FileName: saved.FileName, MimeType: saved.MimeType, Version: saved.Version}
 				}
-			}(i, fileHeader)
+			}(i, file)
 		}
 
 		wg.Wait()
@@ -367,157 +814,176 @@ func ParallelUpload(conn *pgx.Conn) fiber.Handler {
 	}
 }
 
-// saveFileWithDeduplication saves a file with deduplication support
-func saveFileWithDeduplication(conn *pgx.Conn, userID string, fileHeader *multipart.FileHeader) (string, error) {
-	file, err := fileHeader.Open()
-	if err != nil {
-		return "", err
+// uploadOwner is the owner of where a parallel upload goes: the file it
+// uploads a new version of, or the folder the files land in
+func uploadOwner(repo *repository.Repository, userID, fileID, parentID, onConflict string) (string, error) {
+	if fileID == "" {
+		return writableFolder(repo, userID, folderParam(parentID))
 	}
-	defer file.Close()
-
-	// Calculate checksum
-	hash := sha256.New()
-	tempData, err := io.ReadAll(file)
+	target, err := newUploadTarget(repo, userID, fileID, "", "", onConflict)
 	if err != nil {
 		return "", err
 	}
-	hash.Write(tempData)
-	checksum := hex.EncodeToString(hash.Sum(nil))
+	return target.UserID, nil
+}
 
-	// Check if file with same checksum already exists for this user
-	var existingFileID string
-	err = conn.QueryRow(context.Background(),
-		`SELECT id FROM files WHERE user_id=$1 AND checksum=$2 LIMIT 1`,
-		userID, checksum).Scan(&existingFileID)
-
-	if err == nil {
-		// File already exists, create reference instead of storing again
-		newFileID := uuid.New().String()
-		var existingPath string
-		conn.QueryRow(context.Background(),
-			`SELECT file_path FROM files WHERE id=$1`, existingFileID).Scan(&existingPath)
-
-		// Create metadata entry with same file path (deduplication)
-		_, err = conn.Exec(context.Background(),
-			`INSERT INTO files (id, user_id, file_name, original_name, file_path, file_size, checksum, is_folder, created_at, updated_at)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
-			newFileID, userID, newFileID+filepath.Ext(fileHeader.Filename), fileHeader.Filename,
-			existingPath, fileHeader.Size, checksum, false, time.Now(), time.Now())
+// spooledFile is an uploaded file written to a temp file while it was hashed
+type spooledFile struct {
+	Name     string
+	Path     string
+	Size     int64
+	Checksum string
+}
 
+// spoolMultipart reads a multipart body one part at a time. Each file in the
+// "files" field is copied to a temp file from storage.CreateTemp while its
+// SHA-256 is computed; other fields are returned as values. Reading stops
+// with errUploadTooLarge as soon as the files pass maxBytes together. Files
+// spooled before an error, including a partly written one, are returned so
+// the caller can remove them.
+func spoolMultipart(store storage.Backend, body io.Reader, boundary string, maxBytes int64) ([]*spooledFile, map[string]string, error) {
+	reader := multipart.NewReader(body, boundary)
+	values := map[string]string{}
+	var files []*spooledFile
+	remaining := maxBytes
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return files, values, nil
+		}
 		if err != nil {
-			return "", err
+			return files, values, err
 		}
-		return newFileID, nil
-	}
 
-	// File doesn't exist, save it
-	fileID := uuid.New().String()
-	userDir := filepath.Join(StorageDir, "users", userID)
-	if err := os.MkdirAll(userDir, os.ModePerm); err != nil {
-		return "", err
-	}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, 1<<20))
+			if err != nil {
+				return files, values, err
+			}
+			values[part.FormName()] = string(value)
+			continue
+		}
+		if part.FormName() != "files" {
+			continue // NextPart discards the rest of the part
+		}
 
-	filePath := filepath.Join(userDir, fileID+filepath.Ext(fileHeader.Filename))
-	if err := os.WriteFile(filePath, tempData, 0644); err != nil {
-		return "", err
-	}
+		tmp, err := storage.CreateTemp(store, "upload-*")
+		if err != nil {
+			return files, values, err
+		}
+		file := &spooledFile{Name: part.FileName(), Path: tmp.Name()}
+		files = append(files, file)
 
-	// Save metadata
-	_, err = conn.Exec(context.Background(),
-		`INSERT INTO files (id, user_id, file_name, original_name, file_path, file_size, checksum, is_folder, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
-		fileID, userID, fileID+filepath.Ext(fileHeader.Filename), fileHeader.Filename,
-		filePath, fileHeader.Size, checksum, false, time.Now(), time.Now())
+		// One byte past what is left is enough to tell the cap was crossed
+		hash := sha256.New()
+		file.Size, err = io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(part, remaining+1))
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return files, values, err
+		}
+		if file.Size > remaining {
+			return files, values, errUploadTooLarge
+		}
+		remaining -= file.Size
+		file.Checksum = hex.EncodeToString(hash.Sum(nil))
+	}
+}
 
+// saveFileWithDeduplication stores a spooled file as a blob, moving the temp
+// file into place or discarding it when the content is already stored, and
+// records it as target
+func saveFileWithDeduplication(repo *repository.Repository, store storage.Backend, target uploadTarget, file *spooledFile) (*savedUpload, error) {
+	// Sniff the MIME type from the start of the file
+	f, err := os.Open(file.Path)
 	if err != nil {
-		os.Remove(filePath)
-		return "", err
+		return nil, err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	f.Close()
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	target.MimeType = sniffMimeType(head[:n], target.OriginalName)
+
+	// Store the content once under its checksum; identical content from any
+	// user or upload path shares the same blob
+	if err := storeBlobFile(repo, store, file.Checksum, file.Path); err != nil {
+		return nil, err
 	}
 
-	return fileID, nil
+	// Save metadata (a new version when the file already exists)
+	return saveUploadedContent(repo, target, file.Size, file.Checksum)
 }
 
 // ListFiles lists all files for a user
-func ListFiles(conn *pgx.Conn) fiber.Handler {
+func ListFiles(repo *repository.Repository) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		userID := c.Locals("userID").(string)
 		parentID := c.Query("parentId")
 
-		var rows pgx.Rows
-		var err error
-
-		if parentID == "" {
-			rows, err = conn.Query(context.Background(),
-				`SELECT id, file_name, original_name, file_size, is_folder, created_at, updated_at 
-				FROM files WHERE user_id=$1 AND parent_id IS NULL ORDER BY created_at DESC`,
-				userID)
-		} else {
-			rows, err = conn.Query(context.Background(),
-				`SELECT id, file_name, original_name, file_size, is_folder, created_at, updated_at 
-				FROM files WHERE user_id=$1 AND parent_id=$2 ORDER BY created_at DESC`,
-				userID, parentID)
+		// Folders shared with the user are listed as their owner sees them
+		ownerID := userID
+		if parentID != "" {
+			folder, _, err := accessibleFile(repo, parentID, userID, models.RoleViewer)
+			if err != nil || !folder.IsFolder {
+				return c.Status(404).JSON(fiber.Map{"error": "Folder not found"})
+			}
+			ownerID = folder.UserID
 		}
 
+		files, err := repo.Files.List(context.Background(), ownerID, parentID)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
 		}
-		defer rows.Close()
-
-		var files []models.File
-		for rows.Next() {
-			var f models.File
-			err := rows.Scan(&f.ID, &f.FileName, &f.OriginalName, &f.FileSize, &f.IsFolder, &f.CreatedAt, &f.UpdatedAt)
-			if err != nil {
-				continue
-			}
-			files = append(files, f)
-		}
 
 		return c.Status(200).JSON(files)
 	}
 }
 
-// DeleteFile deletes a file
-func DeleteFile(conn *pgx.Conn) fiber.Handler {
+// DeleteFile moves a file or folder, with everything inside it, to the trash
+func DeleteFile(repo *repository.Repository) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		fileID := c.Params("fileId")
 		userID := c.Locals("userID").(string)
 
-		// Get file path
-		var filePath string
-		var checksum string
-		err := conn.QueryRow(context.Background(),
-			`SELECT file_path, checksum FROM files WHERE id=$1 AND user_id=$2`,
-			fileID, userID).Scan(&filePath, &checksum)
-
-		if err != nil {
+		// Editors of a shared folder can delete from it; the item goes to
+		// its owner's trash
+		file, _, err := accessibleFile(repo, fileID, userID, models.RoleEditor)
+		if err == errForbidden {
+			return forbidden(c)
+		}
+		if err == pgx.ErrNoRows {
 			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
 		}
-
-		// Check if other files reference this same physical file (deduplication)
-		var refCount int
-		conn.QueryRow(context.Background(),
-			`SELECT COUNT(*) FROM files WHERE checksum=$1`, checksum).Scan(&refCount)
-
-		// Delete from database
-		_, err = conn.Exec(context.Background(),
-			`DELETE FROM files WHERE id=$1 AND user_id=$2`, fileID, userID)
-
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to delete file"})
 		}
 
-		// Only delete physical file if no other references exist
-		if refCount <= 1 {
-			os.Remove(filePath)
+		// Blob references are kept until the item is purged from the trash.
+		// Revoke-on-change links covering the item stop working with it.
+		err = repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+			if err := revokeSharesOnChange(tx, file, changeTrashed); err != nil {
+				return err
+			}
+			return tx.Files.Trash(context.Background(), fileID, file.UserID)
+		})
+		if err == pgx.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to delete file"})
 		}
 
-		return c.Status(200).JSON(fiber.Map{"message": "File deleted successfully"})
+		return c.Status(200).JSON(fiber.Map{"message": "File moved to trash"})
 	}
 }
 
 // CreateFolder creates a new folder
-func CreateFolder(conn *pgx.Conn) fiber.Handler {
+func CreateFolder(repo *repository.Repository) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		req := struct {
 			FolderName string  `json:"folderName"`
@@ -528,13 +994,38 @@ func CreateFolder(conn *pgx.Conn) fiber.Handler {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 		}
 
+		if !validName(req.FolderName) {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid name"})
+		}
+
 		userID := c.Locals("userID").(string)
 		folderID := uuid.New().String()
 
-		_, err := conn.Exec(context.Background(),
-			`INSERT INTO files (id, user_id, file_name, original_name, parent_id, is_folder, file_size, created_at, updated_at)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
-			folderID, userID, req.FolderName, req.FolderName, req.ParentID, true, 0, time.Now(), time.Now())
+		// A folder created inside a shared folder belongs to its owner
+		if req.ParentID != nil && *req.ParentID == "" {
+			req.ParentID = nil
+		}
+		ownerID, err := writableFolder(repo, userID, req.ParentID)
+		if err == errInvalidParent {
+			return c.Status(400).JSON(fiber.Map{"error": "Parent folder not found"})
+		}
+		if err == errForbidden {
+			return forbidden(c)
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create folder"})
+		}
+
+		err = repo.Files.Create(context.Background(), &models.File{
+			ID:           folderID,
+			UserID:       ownerID,
+			FileName:     req.FolderName,
+			OriginalName: req.FolderName,
+			ParentID:     req.ParentID,
+			IsFolder:     true,
+			CreatedAt:    time.Now(),
+			UpdatedAt:    time.Now(),
+		})
 
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to create folder"})
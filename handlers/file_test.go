@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"bytes"
+	"mime/multipart"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pk0205/dropbox-2.0/storage"
+)
+
+// multipartBody builds a form with the given "files" contents, in order,
+// followed by a parentId field
+func multipartBody(t *testing.T, contents ...string) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for i, content := range contents {
+		part, err := w.CreateFormFile("files", strings.Repeat("f", i+1)+".txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	w.WriteField("parentId", "folder-1")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, w.Boundary()
+}
+
+func TestSpoolMultipartLimit(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		contents []string
+		maxBytes int64
+		tooLarge bool
+	}{
+		{"under", []string{"12345", "67890"}, 20, false},
+		{"exactly", []string{"12345", "67890"}, 10, false},
+		{"first file over", []string{strings.Repeat("x", 100), "67890"}, 10, true},
+		{"total over", []string{"12345", "678901"}, 10, true},
+		{"empty files", []string{"", ""}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, boundary := multipartBody(t, tt.contents...)
+			files, values, err := spoolMultipart(store, body, boundary, tt.maxBytes)
+			defer func() {
+				for _, f := range files {
+					os.Remove(f.Path)
+				}
+			}()
+
+			if tt.tooLarge {
+				if err != errUploadTooLarge {
+					t.Fatalf("err = %v; want errUploadTooLarge", err)
+				}
+				// The partly written file is handed back for removal
+				if len(files) == 0 {
+					t.Fatal("no spooled files returned")
+				}
+				for _, f := range files {
+					if _, err := os.Stat(f.Path); err != nil {
+						t.Errorf("spooled file %s not returned for removal: %v", f.Name, err)
+					}
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(tt.contents) || values["parentId"] != "folder-1" {
+				t.Fatalf("got %d files and values %v", len(files), values)
+			}
+			for i, f := range files {
+				if f.Size != int64(len(tt.contents[i])) {
+					t.Errorf("file %d size = %d; want %d", i, f.Size, len(tt.contents[i]))
+				}
+			}
+		})
+	}
+}
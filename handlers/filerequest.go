@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+	"github.com/pk0205/dropbox-2.0/repository"
+	"github.com/pk0205/dropbox-2.0/storage"
+)
+
+// maxUploaderNameLength caps the name a file request uploader can give
+const maxUploaderNameLength = 200
+
+// normalizeExtensions lower-cases file request extensions and gives each a
+// leading dot, dropping repeats. It fails on anything that isn't a plain
+// extension such as "pdf" or ".tar.gz".
+func normalizeExtensions(extensions []string) ([]string, bool) {
+	var normalized []string
+	seen := map[string]bool{}
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if len(ext) < 2 || len(ext) > 32 || strings.ContainsAny(ext, "/\\\x00 ") {
+			return nil, false
+		}
+		if !seen[ext] {
+			seen[ext] = true
+			normalized = append(normalized, ext)
+		}
+	}
+	return normalized, true
+}
+
+// allowedExtension reports whether a file request accepts name; an empty
+// list accepts anything
+func allowedExtension(name string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	name = strings.ToLower(name)
+	for _, ext := range allowed {
+		if strings.HasSuffix(name, ext) && len(name) > len(ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileRequestSession returns the :uploadId session started through the
+// file request shared, only while it accepts chunks when active is set.
+// Sessions belong to the link's owner, so the share is checked as well to
+// keep uploaders away from the owner's other sessions.
+func fileRequestSession(repo *repository.Repository, c *fiber.Ctx, shared *repository.SharedFile, active bool) (*models.ChunkUpload, error) {
+	get := repo.Uploads.Get
+	if active {
+		get = repo.Uploads.GetActive
+	}
+	upload, err := get(context.Background(), c.Params("uploadId"), shared.Share.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if upload.ShareID == nil || *upload.ShareID != shared.Share.ID || upload.Protocol != "chunked" {
+		return nil, pgx.ErrNoRows
+	}
+	return upload, nil
+}
+
+// FileRequestUploadInit starts a chunked upload through a file request link.
+// The file goes into the shared folder, renamed if the name is taken so an
+// uploader can never replace what is there, and counts against the owner's
+// quota. Chunks are then sent like any chunked upload.
+func FileRequestUploadInit(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		shared, err := openShareKind(repo, c, models.ShareKindUpload)
+		if shared == nil {
+			return err
+		}
+		share := shared.Share
+
+		req := struct {
+			FileName      string `json:"fileName"`
+			TotalSize     int64  `json:"totalSize"`
+			TotalChunks   int    `json:"totalChunks"`
+			Checksum      string `json:"checksum"` // SHA-256 of the whole file, verified on completion
+			UploaderName  string `json:"uploaderName"`
+			UploaderEmail string `json:"uploaderEmail"`
+		}{}
+
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		req.Checksum = strings.ToLower(req.Checksum)
+		if msg := checkChunkedInit(req.TotalSize, req.TotalChunks, req.Checksum); msg != "" {
+			return c.Status(400).JSON(fiber.Map{"error": msg})
+		}
+
+		// The link's limits
+		if share.MaxFileSize != nil && req.TotalSize > *share.MaxFileSize {
+			return c.Status(413).JSON(fiber.Map{
+				"error": fmt.Sprintf("Files must be at most %d bytes", *share.MaxFileSize),
+			})
+		}
+		if !allowedExtension(strings.TrimSpace(req.FileName), share.AllowedExtensions) {
+			return c.Status(400).JSON(fiber.Map{
+				"error":             "File type not allowed",
+				"allowedExtensions": share.AllowedExtensions,
+			})
+		}
+
+		req.UploaderName = strings.TrimSpace(req.UploaderName)
+		req.UploaderEmail = strings.TrimSpace(req.UploaderEmail)
+		if share.RequireUploaderInfo && (req.UploaderName == "" || req.UploaderEmail == "") {
+			return c.Status(400).JSON(fiber.Map{"error": "uploaderName and uploaderEmail are required"})
+		}
+		if len(req.UploaderName) > maxUploaderNameLength {
+			return c.Status(400).JSON(fiber.Map{"error": "uploaderName is too long"})
+		}
+		if req.UploaderEmail != "" {
+			if addr, err := mail.ParseAddress(req.UploaderEmail); err != nil || addr.Address != req.UploaderEmail {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid uploaderEmail"})
+			}
+		}
+
+		target, err := newUploadTarget(repo, share.UserID, "", share.FileID, req.FileName, onConflictRename)
+		if status, msg := uploadErrorStatus(err); status != 0 {
+			return c.Status(status).JSON(fiber.Map{"error": msg})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to initialize upload"})
+		}
+
+		uploadID := uuid.New().String()
+		expiresAt := time.Now().Add(24 * time.Hour)
+
+		err = repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+			if err := checkQuota(tx, share.UserID, req.TotalSize, ""); err != nil {
+				return err
+			}
+			return tx.Uploads.Create(context.Background(), newUploadSession(uploadID, share.UserID, target, "chunked", &models.ChunkUpload{
+				TotalChunks:      req.TotalChunks,
+				ChunkSize:        ChunkSize,
+				TotalSize:        req.TotalSize,
+				ExpectedChecksum: req.Checksum,
+				ShareID:          &share.ID,
+				UploaderName:     req.UploaderName,
+				UploaderEmail:    req.UploaderEmail,
+				ExpiresAt:        expiresAt,
+			}))
+		})
+
+		if err == errQuotaExceeded {
+			return quotaExceeded(c)
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to initialize upload"})
+		}
+
+		return c.Status(200).JSON(fiber.Map{
+			"uploadId":    uploadID,
+			"chunkSize":   ChunkSize,
+			"totalChunks": req.TotalChunks,
+			"expiresAt":   expiresAt,
+		})
+	}
+}
+
+// FileRequestUploadChunk receives one chunk of a file request upload, like
+// ChunkedUploadChunk
+func FileRequestUploadChunk(repo *repository.Repository, store storage.Backend) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		shared, err := openShareKind(repo, c, models.ShareKindUpload)
+		if shared == nil {
+			return err
+		}
+
+		upload, err := fileRequestSession(repo, c, shared, true)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Upload session not found or expired"})
+		}
+
+		return receiveChunk(c, repo, store, upload)
+	}
+}
+
+// FileRequestUploadStatus reports the progress of a file request upload,
+// like ChunkedUploadStatus but without the resulting file's ID
+func FileRequestUploadStatus(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		shared, err := openShareKind(repo, c, models.ShareKindUpload)
+		if shared == nil {
+			return err
+		}
+
+		upload, err := fileRequestSession(repo, c, shared, false)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Upload session not found"})
+		}
+
+		status := uploadStatus(upload)
+		delete(status, "fileId")
+		return c.Status(200).JSON(status)
+	}
+}
+
+// FileRequestUploadComplete assembles a file request upload, synchronously
+// or with ?async=true. The response only confirms receipt: the uploader
+// learns nothing about the folder, not even whether the file was renamed.
+func FileRequestUploadComplete(repo *repository.Repository, store storage.Backend) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		shared, err := openShareKind(repo, c, models.ShareKindUpload)
+		if shared == nil {
+			return err
+		}
+
+		upload, err := fileRequestSession(repo, c, shared, true)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Upload session not found"})
+		}
+
+		saved, err := completeUpload(c, repo, store, upload)
+		if saved == nil {
+			return err
+		}
+
+		entry := newShareAccess(c, &shared.Share, saved.FileID, models.ShareActionUpload)
+		entry.BytesServed = upload.TotalSize
+		recordShareAccess(repo, entry)
+
+		return c.Status(200).JSON(fiber.Map{
+			"message":  "File uploaded successfully",
+			"fileName": upload.FileName,
+			"fileSize": upload.TotalSize,
+			"checksum": saved.Checksum,
+		})
+	}
+}
+
+// ListFileRequestUploads lists the files received through one of the
+// user's file request links and who sent them
+func ListFileRequestUploads(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		shareID := c.Params("shareId")
+		userID := c.Locals("userID").(string)
+
+		share, err := repo.Shares.GetOwned(context.Background(), shareID, userID)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Share link not found"})
+		}
+		if share.Kind != models.ShareKindUpload {
+			return c.Status(400).JSON(fiber.Map{"error": "Not an upload link"})
+		}
+
+		uploads, err := repo.Shares.ListRequestUploads(context.Background(), shareID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get uploads"})
+		}
+		if uploads == nil {
+			uploads = []models.FileRequestUpload{}
+		}
+		return c.Status(200).JSON(uploads)
+	}
+}
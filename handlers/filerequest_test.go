@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeExtensions(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions []string
+		want       []string
+		ok         bool
+	}{
+		{"none", nil, nil, true},
+		{"adds dot", []string{"pdf"}, []string{".pdf"}, true},
+		{"keeps dot", []string{".pdf"}, []string{".pdf"}, true},
+		{"lower-cases and trims", []string{" .PDF ", "Docx"}, []string{".pdf", ".docx"}, true},
+		{"multi-part", []string{"tar.gz"}, []string{".tar.gz"}, true},
+		{"drops repeats", []string{"pdf", ".PDF", "png", "pdf"}, []string{".pdf", ".png"}, true},
+		{"longest allowed", []string{strings.Repeat("a", 31)}, []string{"." + strings.Repeat("a", 31)}, true},
+		{"too long", []string{strings.Repeat("a", 32)}, nil, false},
+		{"empty", []string{""}, nil, false},
+		{"only a dot", []string{"."}, nil, false},
+		{"space inside", []string{"p df"}, nil, false},
+		{"slash", []string{"../pdf"}, nil, false},
+		{"backslash", []string{`a\b`}, nil, false},
+		{"one bad fails all", []string{"pdf", "a/b"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := normalizeExtensions(tt.extensions)
+			if !reflect.DeepEqual(got, tt.want) || ok != tt.ok {
+				t.Errorf("normalizeExtensions(%q) = %q, %v; want %q, %v", tt.extensions, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAllowedExtension(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		allowed []string
+		want    bool
+	}{
+		{"no list", "anything.exe", nil, true},
+		{"match", "report.pdf", []string{".pdf"}, true},
+		{"case-insensitive", "REPORT.PDF", []string{".pdf"}, true},
+		{"second in list", "photo.png", []string{".pdf", ".png"}, true},
+		{"multi-part", "backup.tar.gz", []string{".tar.gz"}, true},
+		{"suffix of multi-part", "backup.tar.gz", []string{".gz"}, true},
+		{"not listed", "script.exe", []string{".pdf", ".png"}, false},
+		{"extension only", ".pdf", []string{".pdf"}, false},
+		{"no extension", "pdf", []string{".pdf"}, false},
+		{"extension in the middle", "report.pdf.exe", []string{".pdf"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowedExtension(tt.file, tt.allowed); got != tt.want {
+				t.Errorf("allowedExtension(%q, %q) = %v; want %v", tt.file, tt.allowed, got, tt.want)
+			}
+		})
+	}
+}
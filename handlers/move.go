@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+	"github.com/pk0205/dropbox-2.0/repository"
+)
+
+var (
+	errNameConflict  = errors.New("an item with this name already exists")
+	errInvalidParent = errors.New("parent is not a folder")
+	errMoveCycle     = errors.New("folder can't be moved into itself")
+)
+
+// Conflict policies for rename, move and copy
+const (
+	onConflictFail   = "fail"
+	onConflictRename = "rename"
+)
+
+// UpdateFile renames and/or moves a file or folder
+func UpdateFile(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fileID := c.Params("fileId")
+		userID := c.Locals("userID").(string)
+
+		req := struct {
+			Name       *string `json:"name"`
+			ParentID   *string `json:"parentId"` // "" moves to the root, omitted keeps the current folder
+			OnConflict string  `json:"onConflict"`
+		}{}
+
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if req.Name == nil && req.ParentID == nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Nothing to update"})
+		}
+		if req.OnConflict == "" {
+			req.OnConflict = onConflictFail
+		}
+		if req.OnConflict != onConflictFail && req.OnConflict != onConflictRename {
+			return c.Status(400).JSON(fiber.Map{"error": "onConflict must be fail or rename"})
+		}
+		if req.Name != nil && !validName(*req.Name) {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid name"})
+		}
+
+		var updated *models.File
+		err := repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+			if err := tx.Files.LockTree(context.Background(), userID); err != nil {
+				return err
+			}
+
+			file, err := tx.Files.GetForUpdate(context.Background(), fileID, userID)
+			if err != nil {
+				return err
+			}
+
+			name, parentID := file.OriginalName, file.ParentID
+			if req.Name != nil {
+				name = strings.TrimSpace(*req.Name)
+			}
+			if req.ParentID != nil {
+				parentID = folderParam(*req.ParentID)
+				if err := checkDestination(tx, file, parentID); err != nil {
+					return err
+				}
+				if err := revokeSharesOnMoveOut(tx, file, parentID); err != nil {
+					return err
+				}
+			}
+
+			name, err = resolveName(tx, userID, parentID, name, file.ID, file.IsFolder, req.OnConflict)
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Files.Move(context.Background(), file.ID, name, parentID); err != nil {
+				return err
+			}
+			updated, err = tx.Files.Get(context.Background(), file.ID, userID)
+			return err
+		})
+
+		if err != nil {
+			return fileOpError(c, err, "Failed to update file")
+		}
+
+		return c.Status(200).JSON(fiber.Map{
+			"message": "File updated successfully",
+			"file":    updated,
+		})
+	}
+}
+
+// CopyFile copies a file, or a folder with everything inside it. Copies
+// reference the same blobs as the originals, so no content is duplicated.
+func CopyFile(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fileID := c.Params("fileId")
+		userID := c.Locals("userID").(string)
+
+		req := struct {
+			Name       *string `json:"name"`
+			ParentID   *string `json:"parentId"` // "" copies to the root, omitted copies next to the original
+			OnConflict string  `json:"onConflict"`
+		}{}
+
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+			}
+		}
+		if req.OnConflict == "" {
+			req.OnConflict = onConflictRename
+		}
+		if req.OnConflict != onConflictFail && req.OnConflict != onConflictRename {
+			return c.Status(400).JSON(fiber.Map{"error": "onConflict must be fail or rename"})
+		}
+		if req.Name != nil && !validName(*req.Name) {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid name"})
+		}
+
+		var rootID string
+		var copied int
+		err := repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+			if err := tx.Files.LockTree(context.Background(), userID); err != nil {
+				return err
+			}
+
+			items, err := tx.Files.Subtree(context.Background(), fileID)
+			if err != nil {
+				return err
+			}
+			if len(items) == 0 || items[0].UserID != userID {
+				return pgx.ErrNoRows
+			}
+			source := items[0]
+
+			name, parentID := source.OriginalName, source.ParentID
+			if req.Name != nil {
+				name = strings.TrimSpace(*req.Name)
+			}
+			if req.ParentID != nil {
+				parentID = folderParam(*req.ParentID)
+				if err := checkDestination(tx, &source, parentID); err != nil {
+					return err
+				}
+			}
+
+			name, err = resolveName(tx, userID, parentID, name, "", source.IsFolder, req.OnConflict)
+			if err != nil {
+				return err
+			}
+
+			// Copies count at full size even though they share blobs
+			var size int64
+			for _, item := range items {
+				size += item.FileSize
+			}
+			if err := checkQuota(tx, userID, size, ""); err != nil {
+				return err
+			}
+
+			// Subtree lists parents first, so every parent is mapped before its children
+			newIDs := make(map[string]string, len(items))
+			now := time.Now()
+			for i, item := range items {
+				newID := uuid.New().String()
+				newIDs[item.ID] = newID
+
+				cp := item
+				cp.ID = newID
+				cp.UserID = userID
+				cp.IsShared = false
+				cp.Version = 1
+				cp.DeletedAt = nil
+				cp.CreatedAt = now
+				cp.UpdatedAt = now
+				if i == 0 {
+					cp.OriginalName = name
+					cp.ParentID = parentID
+				} else {
+					newParent := newIDs[*item.ParentID]
+					cp.ParentID = &newParent
+				}
+				if cp.IsFolder {
+					cp.FileName = cp.OriginalName
+				} else {
+					cp.FileName = newID + filepath.Ext(cp.OriginalName)
+				}
+
+				if cp.BlobID != nil {
+					if err := tx.Blobs.AddRef(context.Background(), *cp.BlobID, cp.FileSize); err != nil {
+						return err
+					}
+				}
+				if err := tx.Files.Create(context.Background(), &cp); err != nil {
+					return err
+				}
+			}
+
+			rootID = newIDs[source.ID]
+			copied = len(items)
+			return nil
+		})
+
+		if err != nil {
+			return fileOpError(c, err, "Failed to copy file")
+		}
+
+		return c.Status(201).JSON(fiber.Map{
+			"message": "File copied successfully",
+			"fileId":  rootID,
+			"copied":  copied,
+		})
+	}
+}
+
+// fileOpError maps errors from rename, move and copy to responses
+func fileOpError(c *fiber.Ctx, err error, fallback string) error {
+	switch err {
+	case pgx.ErrNoRows:
+		return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+	case errInvalidParent:
+		return c.Status(400).JSON(fiber.Map{"error": "Destination folder not found"})
+	case errMoveCycle:
+		return c.Status(400).JSON(fiber.Map{"error": "A folder can't be moved or copied into itself"})
+	case errNameConflict:
+		return c.Status(409).JSON(fiber.Map{"error": "An item with this name already exists"})
+	case errQuotaExceeded:
+		return quotaExceeded(c)
+	}
+	return c.Status(500).JSON(fiber.Map{"error": fallback})
+}
+
+// folderParam turns a parentId parameter into a parent ID ("" is the root)
+func folderParam(parentID string) *string {
+	if parentID == "" {
+		return nil
+	}
+	return &parentID
+}
+
+// validName rejects names that can't be shown as a single path segment
+func validName(name string) bool {
+	name = strings.TrimSpace(name)
+	return name != "" && name != "." && name != ".." && len(name) <= 255 &&
+		!strings.ContainsAny(name, "/\\\x00")
+}
+
+// checkDestination verifies that parentID (nil for the root) is one of the
+// owner's folders and, when item is a folder, not inside item itself
+func checkDestination(tx *repository.Repository, item *models.File, parentID *string) error {
+	if parentID == nil {
+		return nil
+	}
+	if err := checkFolder(tx, item.UserID, parentID); err != nil || !item.IsFolder {
+		return err
+	}
+
+	within, err := tx.Files.IsWithin(context.Background(), *parentID, item.ID)
+	if err != nil {
+		return err
+	}
+	if within {
+		return errMoveCycle
+	}
+	return nil
+}
+
+// resolveName applies the conflict policy to name within parentID. With
+// rename, "report.pdf" becomes "report (1).pdf", "report (2).pdf" and so on.
+// The caller must hold the tree lock.
+func resolveName(tx *repository.Repository, userID string, parentID *string, name, excludeID string, isFolder bool, onConflict string) (string, error) {
+	return freeName(name, isFolder, onConflict, func(candidate string) (bool, error) {
+		return tx.Files.NameExists(context.Background(), userID, parentID, candidate, excludeID)
+	})
+}
+
+// freeName is resolveName against taken, which reports whether a name is
+// already in use
+func freeName(name string, isFolder bool, onConflict string, taken func(string) (bool, error)) (string, error) {
+	base, ext := name, ""
+	if !isFolder {
+		ext = filepath.Ext(name)
+		base = strings.TrimSuffix(name, ext)
+	}
+
+	candidate := name
+	for n := 1; ; n++ {
+		exists, err := taken(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+		if onConflict != onConflictRename {
+			return "", errNameConflict
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"report.pdf", true},
+		{"My Documents", true},
+		{".hidden", true},
+		{"...", true},
+		{"résumé.pdf", true},
+		{strings.Repeat("a", 255), true},
+		{strings.Repeat("a", 256), false},
+		{"", false},
+		{"   ", false},
+		{".", false},
+		{"..", false},
+		{" .. ", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"a\x00b", false},
+	}
+	for _, tt := range tests {
+		if got := validName(tt.name); got != tt.want {
+			t.Errorf("validName(%q) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFreeName(t *testing.T) {
+	errLookup := errors.New("lookup failed")
+	tests := []struct {
+		name       string
+		taken      []string
+		item       string
+		isFolder   bool
+		onConflict string
+		want       string
+		err        error
+	}{
+		{"free", nil, "report.pdf", false, onConflictRename, "report.pdf", nil},
+		{"free with fail", []string{"other.pdf"}, "report.pdf", false, onConflictFail, "report.pdf", nil},
+		{"renamed", []string{"report.pdf"}, "report.pdf", false, onConflictRename, "report (1).pdf", nil},
+		{"skips taken numbers", []string{"report.pdf", "report (1).pdf", "report (2).pdf"}, "report.pdf", false, onConflictRename, "report (3).pdf", nil},
+		{"last extension only", []string{"archive.tar.gz"}, "archive.tar.gz", false, onConflictRename, "archive.tar (1).gz", nil},
+		{"no extension", []string{"Makefile"}, "Makefile", false, onConflictRename, "Makefile (1)", nil},
+		{"folder keeps dots", []string{"v1.2"}, "v1.2", true, onConflictRename, "v1.2 (1)", nil},
+		{"conflict with fail", []string{"report.pdf"}, "report.pdf", false, onConflictFail, "", errNameConflict},
+		{"conflict with version", []string{"report.pdf"}, "report.pdf", false, onConflictVersion, "", errNameConflict},
+		{"lookup error", nil, "fail", false, onConflictRename, "", errLookup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taken := func(candidate string) (bool, error) {
+				if candidate == "fail" {
+					return false, errLookup
+				}
+				return slices.Contains(tt.taken, candidate), nil
+			}
+			got, err := freeName(tt.item, tt.isFolder, tt.onConflict, taken)
+			if got != tt.want || err != tt.err {
+				t.Errorf("freeName(%q) = %q, %v; want %q, %v", tt.item, got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
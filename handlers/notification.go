@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+	"github.com/pk0205/dropbox-2.0/repository"
+)
+
+// maxNotificationPageSize is the most notifications returned at once
+const maxNotificationPageSize = 200
+
+// ListNotifications returns the user's notifications, newest first: the
+// latest ?limit= (50 by default), only unread ones with ?unread=true
+func ListNotifications(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(string)
+
+		limit := c.QueryInt("limit", 50)
+		if limit < 1 || limit > maxNotificationPageSize {
+			return c.Status(400).JSON(fiber.Map{"error": "limit must be between 1 and 200"})
+		}
+
+		notifications, err := repo.Notifications.List(context.Background(), userID, c.QueryBool("unread"), limit)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get notifications"})
+		}
+		if notifications == nil {
+			notifications = []models.Notification{}
+		}
+		unread, err := repo.Notifications.CountUnread(context.Background(), userID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get notifications"})
+		}
+
+		return c.Status(200).JSON(fiber.Map{
+			"unread":        unread,
+			"notifications": notifications,
+		})
+	}
+}
+
+// MarkNotificationRead marks one of the user's notifications read
+func MarkNotificationRead(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(string)
+
+		err := repo.Notifications.MarkRead(context.Background(), c.Params("notificationId"), userID)
+		if err == pgx.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Notification not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to update notification"})
+		}
+		return c.Status(200).JSON(fiber.Map{"message": "Notification marked as read"})
+	}
+}
+
+// MarkAllNotificationsRead marks every unread notification of the user read
+func MarkAllNotificationsRead(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(string)
+
+		marked, err := repo.Notifications.MarkAllRead(context.Background(), userID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to update notifications"})
+		}
+		return c.Status(200).JSON(fiber.Map{
+			"message": "Notifications marked as read",
+			"marked":  marked,
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+	"github.com/pk0205/dropbox-2.0/repository"
+)
+
+// errForbidden is returned when the user can see an item but their role
+// doesn't allow the operation
+var errForbidden = errors.New("permission denied")
+
+// roleRanks orders roles by how much they allow; unknown roles rank 0
+var roleRanks = map[string]int{
+	models.RoleViewer:    1,
+	models.RoleCommenter: 2,
+	models.RoleEditor:    3,
+	models.RoleOwner:     4,
+}
+
+// accessibleFile returns a live item and the user's role on it: owner for
+// their own items, otherwise the highest role granted on it or a folder
+// above it. Items the user has no role on are pgx.ErrNoRows, so their
+// existence isn't revealed; a role below minRole is errForbidden.
+func accessibleFile(repo *repository.Repository, fileID, userID, minRole string) (*models.File, string, error) {
+	file, err := repo.Files.GetByID(context.Background(), fileID)
+	if err != nil {
+		return nil, "", err
+	}
+	role := models.RoleOwner
+	if file.UserID != userID {
+		role, err = repo.Permissions.Role(context.Background(), fileID, userID)
+		if err != nil {
+			return nil, "", err
+		}
+		if role == "" {
+			return nil, "", pgx.ErrNoRows
+		}
+	}
+	if roleRanks[role] < roleRanks[minRole] {
+		return nil, role, errForbidden
+	}
+	return file, role, nil
+}
+
+// writableFolder checks that the user may add items to parentID (nil for
+// their own root) and returns who owns what is added there: the folder's
+// owner, so a shared tree and its quota stay with one user
+func writableFolder(repo *repository.Repository, userID string, parentID *string) (string, error) {
+	if parentID == nil {
+		return userID, nil
+	}
+	folder, _, err := accessibleFile(repo, *parentID, userID, models.RoleEditor)
+	if err == pgx.ErrNoRows || err == nil && !folder.IsFolder {
+		return "", errInvalidParent
+	}
+	if err != nil {
+		return "", err
+	}
+	return folder.UserID, nil
+}
+
+// forbidden is the response for errForbidden
+func forbidden(c *fiber.Ctx) error {
+	return c.Status(403).JSON(fiber.Map{"error": "Permission denied"})
+}
+
+// ListPermissions lists the grants made on an item; only its owners may see them
+func ListPermissions(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fileID := c.Params("fileId")
+		userID := c.Locals("userID").(string)
+
+		if _, _, err := accessibleFile(repo, fileID, userID, models.RoleOwner); err == errForbidden {
+			return forbidden(c)
+		} else if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+		}
+
+		permissions, err := repo.Permissions.List(context.Background(), fileID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get permissions"})
+		}
+		if permissions == nil {
+			permissions = []models.Permission{}
+		}
+		return c.Status(200).JSON(permissions)
+	}
+}
+
+// GrantPermission gives a user (by username) or a group a role on an item
+// and, for folders, everything inside it. Granting again changes the role.
+func GrantPermission(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fileID := c.Params("fileId")
+		userID := c.Locals("userID").(string)
+
+		req := struct {
+			Username string `json:"username"`
+			GroupID  string `json:"groupId"`
+			Role     string `json:"role"`
+		}{}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if _, ok := roleRanks[req.Role]; !ok {
+			return c.Status(400).JSON(fiber.Map{"error": "role must be viewer, commenter, editor or owner"})
+		}
+		if (req.Username == "") == (req.GroupID == "") {
+			return c.Status(400).JSON(fiber.Map{"error": "Provide either username or groupId"})
+		}
+
+		file, _, err := accessibleFile(repo, fileID, userID, models.RoleOwner)
+		if err == errForbidden {
+			return forbidden(c)
+		}
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+		}
+
+		permission := &models.Permission{
+			ID:        uuid.New().String(),
+			FileID:    fileID,
+			Role:      req.Role,
+			GrantedBy: userID,
+			CreatedAt: time.Now(),
+		}
+		if req.Username != "" {
+			grantee, _, err := repo.Users.GetByUsername(context.Background(), strings.TrimSpace(req.Username))
+			if err != nil {
+				return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+			}
+			if grantee.ID == file.UserID {
+				return c.Status(400).JSON(fiber.Map{"error": "The owner already has full access"})
+			}
+			permission.UserID = &grantee.ID
+			permission.Grantee = grantee.Username
+		} else {
+			group, err := repo.Groups.Get(context.Background(), req.GroupID)
+			if err != nil {
+				return c.Status(404).JSON(fiber.Map{"error": "Group not found"})
+			}
+			permission.GroupID = &group.ID
+			permission.Grantee = group.Name
+		}
+
+		if err := repo.Permissions.Grant(context.Background(), permission); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to grant permission"})
+		}
+		return c.Status(201).JSON(permission)
+	}
+}
+
+// RevokePermission removes a grant from an item
+func RevokePermission(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fileID := c.Params("fileId")
+		userID := c.Locals("userID").(string)
+
+		if _, _, err := accessibleFile(repo, fileID, userID, models.RoleOwner); err == errForbidden {
+			return forbidden(c)
+		} else if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+		}
+
+		err := repo.Permissions.Revoke(context.Background(), c.Params("permissionId"), fileID)
+		if err == pgx.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Permission not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to revoke permission"})
+		}
+		return c.Status(200).JSON(fiber.Map{"message": "Permission revoked"})
+	}
+}
+
+// ListSharedWithMe lists the items other users have shared with the user
+// or one of their groups. Folders are browsed with ListFiles?parentId=.
+func ListSharedWithMe(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(string)
+
+		items, err := repo.Permissions.SharedWith(context.Background(), userID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get shared items"})
+		}
+		if items == nil {
+			items = []models.SharedItem{}
+		}
+		return c.Status(200).JSON(items)
+	}
+}
+
+// CreateGroup creates a group owned by the user, optionally with members
+func CreateGroup(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(string)
+
+		req := struct {
+			Name    string   `json:"name"`
+			Members []string `json:"members"` // Usernames
+		}{}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "name is required"})
+		}
+
+		// Resolve every member first so a typo doesn't leave a half-made group
+		var memberIDs []string
+		for _, username := range req.Members {
+			member, _, err := repo.Users.GetByUsername(context.Background(), strings.TrimSpace(username))
+			if err != nil {
+				return c.Status(404).JSON(fiber.Map{"error": "User not found: " + username})
+			}
+			memberIDs = append(memberIDs, member.ID)
+		}
+
+		group := &models.Group{ID: uuid.New().String(), Name: req.Name, OwnerID: userID, CreatedAt: time.Now()}
+		err := repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+			if err := tx.Groups.Create(context.Background(), group); err != nil {
+				return err
+			}
+			for _, memberID := range memberIDs {
+				if err := tx.Groups.AddMember(context.Background(), group.ID, memberID); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create group"})
+		}
+
+		created, err := repo.Groups.Get(context.Background(), group.ID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get group"})
+		}
+		return c.Status(201).JSON(created)
+	}
+}
+
+// ListGroups lists the groups the user owns or belongs to
+func ListGroups(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(string)
+
+		groups, err := repo.Groups.ListForUser(context.Background(), userID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get groups"})
+		}
+		if groups == nil {
+			groups = []models.Group{}
+		}
+		return c.Status(200).JSON(groups)
+	}
+}
+
+// AddGroupMember adds a user to a group the caller owns
+func AddGroupMember(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(string)
+
+		req := struct {
+			Username string `json:"username"`
+		}{}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+
+		group, err := repo.Groups.Get(context.Background(), c.Params("groupId"))
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Group not found"})
+		}
+		if group.OwnerID != userID {
+			return forbidden(c)
+		}
+
+		member, _, err := repo.Users.GetByUsername(context.Background(), strings.TrimSpace(req.Username))
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+		}
+		if err := repo.Groups.AddMember(context.Background(), group.ID, member.ID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to add member"})
+		}
+		return c.Status(200).JSON(fiber.Map{"message": "Member added"})
+	}
+}
+
+// RemoveGroupMember removes a user from a group. The group's owner can
+// remove anyone; members can remove themselves.
+func RemoveGroupMember(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(string)
+
+		group, err := repo.Groups.Get(context.Background(), c.Params("groupId"))
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Group not found"})
+		}
+		member, _, err := repo.Users.GetByUsername(context.Background(), c.Params("username"))
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+		}
+		if group.OwnerID != userID && member.ID != userID {
+			return forbidden(c)
+		}
+
+		err = repo.Groups.RemoveMember(context.Background(), group.ID, member.ID)
+		if err == pgx.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "User is not a member"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to remove member"})
+		}
+		return c.Status(200).JSON(fiber.Map{"message": "Member removed"})
+	}
+}
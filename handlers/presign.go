@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pk0205/dropbox-2.0/models"
+	"github.com/pk0205/dropbox-2.0/repository"
+	"github.com/pk0205/dropbox-2.0/storage"
+)
+
+const (
+	DefaultPresignTTL = time.Hour          // Lifetime of a presigned URL when none is asked for
+	MaxPresignTTL     = 7 * 24 * time.Hour // Longest a presigned URL can last
+)
+
+// presignedURL is what a presigned download URL grants. Every field is
+// covered by its signature, so none can be changed by whoever holds it.
+type presignedURL struct {
+	FileID  string
+	UserID  string // Who signed it; their access to the file is checked again on use
+	Expires int64  // Unix seconds
+	IP      string // Only this client address may use it, optional
+	Range   string // "start-end" byte span it is limited to, optional
+}
+
+// signature is the hex HMAC-SHA256 of the grant under SECRET_KEY
+func (p presignedURL) signature() string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("SECRET_KEY")))
+	fmt.Fprintf(mac, "presign\n%s\n%s\n%d\n%s\n%s", p.FileID, p.UserID, p.Expires, p.IP, p.Range)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// url is the signed, unauthenticated URL of the grant
+func (p presignedURL) url() string {
+	query := url.Values{}
+	query.Set("uid", p.UserID)
+	query.Set("expires", strconv.FormatInt(p.Expires, 10))
+	if p.IP != "" {
+		query.Set("ip", p.IP)
+	}
+	if p.Range != "" {
+		query.Set("range", p.Range)
+	}
+	query.Set("sig", p.signature())
+	return fmt.Sprintf("%s/presigned/%s?%s", publicBaseURL(), url.PathEscape(p.FileID), query.Encode())
+}
+
+// parseByteSpan parses an inclusive "start-end" byte span
+func parseByteSpan(span string) (int64, int64, bool) {
+	first, last, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// PresignDownload creates a URL that downloads a file without the AuthToken
+// cookie until it expires, for media players, CI jobs and other services.
+// It can be tied to one client address and to a byte span of the file.
+func PresignDownload(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fileID := c.Params("fileId")
+		userID := c.Locals("userID").(string)
+
+		req := struct {
+			ExpiresIn int    `json:"expiresIn"` // Seconds, defaults to an hour
+			IP        string `json:"ip"`        // Client address allowed to use the URL (optional)
+			Range     string `json:"range"`     // Byte span "start-end" the URL is limited to (optional)
+		}{}
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+			}
+		}
+
+		ttl := DefaultPresignTTL
+		if req.ExpiresIn != 0 {
+			ttl = time.Duration(req.ExpiresIn) * time.Second
+		}
+		if ttl <= 0 || ttl > MaxPresignTTL {
+			return c.Status(400).JSON(fiber.Map{
+				"error": fmt.Sprintf("expiresIn must be between 1 and %d seconds", int(MaxPresignTTL.Seconds())),
+			})
+		}
+
+		file, _, err := accessibleFile(repo, fileID, userID, models.RoleViewer)
+		if err != nil || file.IsFolder {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+		}
+
+		grant := presignedURL{FileID: file.ID, UserID: userID, Expires: time.Now().Add(ttl).Unix()}
+		if req.IP != "" {
+			ip := net.ParseIP(strings.TrimSpace(req.IP))
+			if ip == nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid ip"})
+			}
+			grant.IP = ip.String()
+		}
+		if req.Range != "" {
+			start, end, ok := parseByteSpan(req.Range)
+			if !ok || start >= file.FileSize {
+				return c.Status(400).JSON(fiber.Map{"error": "range must be start-end within the file"})
+			}
+			grant.Range = fmt.Sprintf("%d-%d", start, min(end, file.FileSize-1))
+		}
+
+		return c.Status(200).JSON(fiber.Map{
+			"url":       grant.url(),
+			"fileId":    file.ID,
+			"fileName":  file.OriginalName,
+			"expiresAt": time.Unix(grant.Expires, 0),
+			"ip":        grant.IP,
+			"range":     grant.Range,
+		})
+	}
+}
+
+// PresignedDownload serves a URL from PresignDownload without
+// authentication, with the same range and conditional request handling as
+// StreamDownload, after checking its signature and constraints
+func PresignedDownload(repo *repository.Repository, store storage.Backend) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+		if err != nil {
+			return c.Status(403).JSON(fiber.Map{"error": "Invalid signature"})
+		}
+		grant := presignedURL{
+			FileID:  c.Params("fileId"),
+			UserID:  c.Query("uid"),
+			Expires: expires,
+			IP:      c.Query("ip"),
+			Range:   c.Query("range"),
+		}
+		if !hmac.Equal([]byte(c.Query("sig")), []byte(grant.signature())) {
+			return c.Status(403).JSON(fiber.Map{"error": "Invalid signature"})
+		}
+		if time.Now().Unix() >= grant.Expires {
+			return c.Status(410).JSON(fiber.Map{"error": "URL has expired"})
+		}
+		if grant.IP != "" && c.IP() != grant.IP {
+			return c.Status(403).JSON(fiber.Map{"error": "URL is not valid from this address"})
+		}
+
+		// The signer may have lost access, or the file been deleted, since
+		file, _, err := accessibleFile(repo, grant.FileID, grant.UserID, models.RoleViewer)
+		if err != nil || file.IsFolder {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+		}
+
+		if grant.Range != "" {
+			start, end, _ := parseByteSpan(grant.Range)
+			if !limitRange(c, start, end, file.FileSize) {
+				c.Set("Content-Range", fmt.Sprintf("bytes */%d", file.FileSize))
+				return c.Status(416).JSON(fiber.Map{"error": "Range not satisfiable"})
+			}
+		}
+
+		return serveDownload(c, store, fileDownload(file))
+	}
+}
+
+// limitRange confines a request to the byte span start-end before it goes
+// to serveDownload: without a Range header it asks for the whole span, and
+// every range it asks for must lie inside the span. It reports false when
+// the request can't be served within the span.
+func limitRange(c *fiber.Ctx, start, end, size int64) bool {
+	// A stale If-Range would otherwise turn the response into the whole file
+	c.Request().Header.Del("If-Range")
+
+	end = min(end, size-1)
+	if start > end {
+		return false
+	}
+	header := c.Get("Range")
+	if header == "" {
+		c.Request().Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		return true
+	}
+
+	// Headers serveDownload would ignore would also mean the whole file
+	ranges, ok := parseRange(header, size)
+	if !ok || ranges == nil {
+		return false
+	}
+	for _, r := range ranges {
+		if r.start < start || r.start+r.length-1 > end {
+			return false
+		}
+	}
+	return true
+}
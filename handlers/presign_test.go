@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestPresignedURLSignature(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-secret")
+	t.Setenv("BASE_URL", "https://files.example.com")
+
+	grant := presignedURL{FileID: "file-1", UserID: "user-1", Expires: 1700000000, IP: "203.0.113.7", Range: "0-99"}
+	sig := grant.signature()
+	if len(sig) != 64 || grant.signature() != sig {
+		t.Fatalf("signature %q isn't a stable hex SHA-256 HMAC", sig)
+	}
+
+	// Every field is covered, so changing any of them breaks the signature
+	for name, changed := range map[string]presignedURL{
+		"file":    {FileID: "file-2", UserID: "user-1", Expires: 1700000000, IP: "203.0.113.7", Range: "0-99"},
+		"user":    {FileID: "file-1", UserID: "user-2", Expires: 1700000000, IP: "203.0.113.7", Range: "0-99"},
+		"expires": {FileID: "file-1", UserID: "user-1", Expires: 1700000001, IP: "203.0.113.7", Range: "0-99"},
+		"ip":      {FileID: "file-1", UserID: "user-1", Expires: 1700000000, IP: "", Range: "0-99"},
+		"range":   {FileID: "file-1", UserID: "user-1", Expires: 1700000000, IP: "203.0.113.7", Range: "0-999"},
+		// Fields can't be shifted into each other across the separators
+		"shifted": {FileID: "file-1", UserID: "user-1", Expires: 1700000000, IP: "203.0.113.70-99", Range: ""},
+	} {
+		if changed.signature() == sig {
+			t.Errorf("changing %s keeps the signature", name)
+		}
+	}
+
+	t.Setenv("SECRET_KEY", "other-secret")
+	if grant.signature() == sig {
+		t.Error("signature doesn't depend on SECRET_KEY")
+	}
+}
+
+func TestPresignedURLRoundTrip(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-secret")
+	t.Setenv("BASE_URL", "https://files.example.com")
+
+	for _, grant := range []presignedURL{
+		{FileID: "file-1", UserID: "user-1", Expires: 1700000000},
+		{FileID: "file-1", UserID: "user-1", Expires: 1700000000, IP: "2001:db8::1", Range: "100-199"},
+	} {
+		u, err := url.Parse(grant.url())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Host != "files.example.com" || u.Path != "/presigned/"+grant.FileID {
+			t.Errorf("url %s points at the wrong place", u)
+		}
+
+		// Read back the way PresignedDownload reads it
+		query := u.Query()
+		expires, _ := strconv.ParseInt(query.Get("expires"), 10, 64)
+		parsed := presignedURL{
+			FileID:  strings.TrimPrefix(u.Path, "/presigned/"),
+			UserID:  query.Get("uid"),
+			Expires: expires,
+			IP:      query.Get("ip"),
+			Range:   query.Get("range"),
+		}
+		if parsed != grant || query.Get("sig") != grant.signature() {
+			t.Errorf("url %s reads back as %+v", u, parsed)
+		}
+	}
+}
+
+func TestParseByteSpan(t *testing.T) {
+	tests := []struct {
+		span       string
+		start, end int64
+		ok         bool
+	}{
+		{"0-99", 0, 99, true},
+		{"5-5", 5, 5, true},
+		{"10-9", 0, 0, false},
+		{"-5-10", 0, 0, false},
+		{"5-", 0, 0, false},
+		{"-10", 0, 0, false},
+		{"10", 0, 0, false},
+		{"a-b", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, end, ok := parseByteSpan(tt.span)
+		if start != tt.start || end != tt.end || ok != tt.ok {
+			t.Errorf("parseByteSpan(%q) = %d, %d, %v; want %d, %d, %v", tt.span, start, end, ok, tt.start, tt.end, tt.ok)
+		}
+	}
+}
+
+func TestLimitRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		rangeHdr   string
+		start, end int64
+		size       int64
+		ok         bool
+		wantRange  string
+	}{
+		{"no range asks for the span", "", 10, 19, 100, true, "bytes=10-19"},
+		{"span end past size", "", 90, 200, 100, true, "bytes=90-99"},
+		{"span past size", "", 100, 200, 100, false, ""},
+		{"range inside", "bytes=12-15", 10, 19, 100, true, "bytes=12-15"},
+		{"whole span", "bytes=10-19", 10, 19, 100, true, "bytes=10-19"},
+		{"several inside", "bytes=10-11,18-19", 10, 19, 100, true, "bytes=10-11,18-19"},
+		{"starts before", "bytes=9-15", 10, 19, 100, false, ""},
+		{"ends after", "bytes=15-20", 10, 19, 100, false, ""},
+		{"open-ended", "bytes=10-", 10, 19, 100, false, ""},
+		{"suffix", "bytes=-5", 95, 99, 100, true, "bytes=-5"},
+		{"suffix outside", "bytes=-5", 10, 19, 100, false, ""},
+		{"one outside", "bytes=10-11,50-51", 10, 19, 100, false, ""},
+		{"ignored header", "items=10-11", 10, 19, 100, false, ""},
+		{"unsatisfiable", "bytes=200-", 10, 19, 100, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ok bool
+			var gotRange, gotIfRange string
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error {
+				ok = limitRange(c, tt.start, tt.end, tt.size)
+				gotRange, gotIfRange = c.Get("Range"), c.Get("If-Range")
+				return nil
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("If-Range", `"stale"`)
+			if tt.rangeHdr != "" {
+				req.Header.Set("Range", tt.rangeHdr)
+			}
+			if _, err := app.Test(req); err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.ok {
+				t.Errorf("limitRange = %v; want %v", ok, tt.ok)
+			}
+			if ok && gotRange != tt.wantRange {
+				t.Errorf("Range = %q; want %q", gotRange, tt.wantRange)
+			}
+			if gotIfRange != "" {
+				t.Errorf("If-Range %q was kept", gotIfRange)
+			}
+		})
+	}
+}
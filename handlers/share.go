@@ -6,40 +6,117 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/pk0205/dropbox-2.0/models"
+	"github.com/pk0205/dropbox-2.0/repository"
+	"github.com/pk0205/dropbox-2.0/storage"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// CreateShareLink creates a shareable link for a file or folder
-func CreateShareLink(conn *pgx.Conn) fiber.Handler {
+// publicBaseURL is where clients reach the server, for links handed out to them
+func publicBaseURL() string {
+	if baseURL := os.Getenv("BASE_URL"); baseURL != "" {
+		return baseURL
+	}
+	return fmt.Sprintf("http://localhost:%s", os.Getenv("PORT"))
+}
+
+// CreateShareLink creates a shareable link for a file or folder. With type
+// "upload" it creates a file request instead: a link to one of the user's
+// folders that anyone can upload into without seeing its contents. Read
+// links follow changes to the item by default; onChange "pin" keeps a file
+// link on the version it was created at, and "revoke" makes the link stop
+// working once the item changes.
+func CreateShareLink(repo *repository.Repository) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		req := struct {
 			FileID    string  `json:"fileId"`
 			ExpiresIn *int    `json:"expiresIn"` // Hours until expiration (optional)
 			Password  *string `json:"password"`  // Optional password protection
+			Type      string  `json:"type"`      // read (default) or upload
+
+			// Download limits, only for read links
+			MaxDownloads *int `json:"maxDownloads"` // Downloads allowed before the link stops working
+			OneTime      bool `json:"oneTime"`      // Same as maxDownloads 1
+
+			// What a read link does when the item changes: follow (default), pin or revoke
+			OnChange string `json:"onChange"`
+
+			// File request limits, only for upload links
+			MaxFileSize         *int64   `json:"maxFileSize"`         // Bytes
+			AllowedExtensions   []string `json:"allowedExtensions"`   // e.g. ["pdf", ".docx"]
+			RequireUploaderInfo bool     `json:"requireUploaderInfo"` // Uploaders must give a name and email
 		}{}
 
 		if err := c.BodyParser(&req); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 		}
 
+		if req.Type == "" {
+			req.Type = models.ShareKindRead
+		}
+		if req.Type != models.ShareKindRead && req.Type != models.ShareKindUpload {
+			return c.Status(400).JSON(fiber.Map{"error": "type must be read or upload"})
+		}
+		isRequest := req.Type == models.ShareKindUpload
+		if !isRequest && (req.MaxFileSize != nil || len(req.AllowedExtensions) > 0 || req.RequireUploaderInfo) {
+			return c.Status(400).JSON(fiber.Map{"error": "Upload limits only apply to upload links"})
+		}
+		if req.OneTime {
+			if req.MaxDownloads != nil && *req.MaxDownloads != 1 {
+				return c.Status(400).JSON(fiber.Map{"error": "oneTime links allow exactly one download"})
+			}
+			one := 1
+			req.MaxDownloads = &one
+		}
+		if isRequest && req.MaxDownloads != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Download limits only apply to read links"})
+		}
+		if req.MaxDownloads != nil && *req.MaxDownloads <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "maxDownloads must be positive"})
+		}
+		if req.OnChange == "" {
+			req.OnChange = models.ShareOnChangeFollow
+		}
+		if req.OnChange != models.ShareOnChangeFollow && req.OnChange != models.ShareOnChangePin && req.OnChange != models.ShareOnChangeRevoke {
+			return c.Status(400).JSON(fiber.Map{"error": "onChange must be follow, pin or revoke"})
+		}
+		if isRequest && req.OnChange != models.ShareOnChangeFollow {
+			return c.Status(400).JSON(fiber.Map{"error": "onChange only applies to read links"})
+		}
+		if req.MaxFileSize != nil && *req.MaxFileSize <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "maxFileSize must be positive"})
+		}
+		extensions, ok := normalizeExtensions(req.AllowedExtensions)
+		if !ok {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid file extension"})
+		}
+
 		userID := c.Locals("userID").(string)
 
 		// Verify file exists and belongs to user
-		var fileName string
-		var isFolder bool
-		err := conn.QueryRow(context.Background(),
-			`SELECT original_name, is_folder FROM files WHERE id=$1 AND user_id=$2`,
-			req.FileID, userID).Scan(&fileName, &isFolder)
-
+		file, err := repo.Files.Get(context.Background(), req.FileID, userID)
 		if err != nil {
 			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
 		}
+		if isRequest && !file.IsFolder {
+			return c.Status(400).JSON(fiber.Map{"error": "Upload links must point at a folder"})
+		}
+
+		// Pinned links remember the content they were created with
+		var pinnedVersion *int
+		var pinnedChecksum *string
+		if req.OnChange == models.ShareOnChangePin {
+			if file.IsFolder {
+				return c.Status(400).JSON(fiber.Map{"error": "Only file links can be pinned"})
+			}
+			pinnedVersion, pinnedChecksum = &file.Version, &file.Checksum
+		}
 
 		// Generate random token
 		tokenBytes := make([]byte, 32)
@@ -66,198 +143,314 @@ func CreateShareLink(conn *pgx.Conn) fiber.Handler {
 			hashedPassword = &hashStr
 		}
 
-		// Create share link
-		_, err = conn.Exec(context.Background(),
-			`INSERT INTO share_links (id, file_id, user_id, token, expires_at, password, created_at)
-			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-			shareID, req.FileID, userID, token, expiresAt, hashedPassword, time.Now())
+		// Create share link and mark file as shared together
+		err = repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+			err := tx.Shares.Create(context.Background(), &models.ShareLink{
+				ID:        shareID,
+				FileID:    req.FileID,
+				UserID:    userID,
+				Token:     token,
+				ExpiresAt: expiresAt,
+				Password:  hashedPassword,
+				CreatedAt: time.Now(),
+				Kind:      req.Type,
+
+				MaxFileSize:         req.MaxFileSize,
+				AllowedExtensions:   extensions,
+				RequireUploaderInfo: req.RequireUploaderInfo,
+				MaxDownloads:        req.MaxDownloads,
+
+				OnChange:       req.OnChange,
+				PinnedVersion:  pinnedVersion,
+				PinnedChecksum: pinnedChecksum,
+			})
+			if err != nil {
+				return err
+			}
+			return tx.Files.SetShared(context.Background(), req.FileID, true)
+		})
 
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to create share link"})
 		}
 
-		// Mark file as shared
-		conn.Exec(context.Background(),
-			`UPDATE files SET is_shared = true WHERE id=$1`, req.FileID)
-
 		// Build share URL
-		baseURL := os.Getenv("BASE_URL")
-		if baseURL == "" {
-			baseURL = fmt.Sprintf("http://localhost:%s", os.Getenv("PORT"))
-		}
-		shareURL := fmt.Sprintf("%s/share/%s", baseURL, token)
-
-		return c.Status(201).JSON(fiber.Map{
-			"message":        "Share link created successfully",
-			"shareId":        shareID,
-			"shareUrl":       shareURL,
-			"token":          token,
-			"fileName":       fileName,
-			"isFolder":       isFolder,
-			"expiresAt":      expiresAt,
+		shareURL := fmt.Sprintf("%s/share/%s", publicBaseURL(), token)
+
+		response := fiber.Map{
+			"message":           "Share link created successfully",
+			"shareId":           shareID,
+			"shareUrl":          shareURL,
+			"token":             token,
+			"type":              req.Type,
+			"fileName":          file.OriginalName,
+			"isFolder":          file.IsFolder,
+			"expiresAt":         expiresAt,
 			"passwordProtected": hashedPassword != nil,
-		})
+		}
+		if req.MaxDownloads != nil {
+			response["maxDownloads"] = *req.MaxDownloads
+		}
+		if !isRequest {
+			response["onChange"] = req.OnChange
+		}
+		if pinnedVersion != nil {
+			response["pinnedVersion"] = *pinnedVersion
+		}
+		if isRequest {
+			response["maxFileSize"] = req.MaxFileSize
+			response["allowedExtensions"] = extensions
+			response["requireUploaderInfo"] = req.RequireUploaderInfo
+		}
+		return c.Status(201).JSON(response)
 	}
 }
 
-// GetSharedFile handles public access to shared files
-func GetSharedFile(conn *pgx.Conn) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		token := c.Params("token")
-		password := c.Query("password") // Optional password from query
-
-		// Get share link info
-		var shareLink models.ShareLink
-		var fileID string
-		var filePath string
-		var fileName string
-		var fileSize int64
-		var isFolder bool
-		var storedPassword *string
-
-		err := conn.QueryRow(context.Background(),
-			`SELECT sl.id, sl.file_id, sl.user_id, sl.expires_at, sl.password,
-			f.file_path, f.original_name, f.file_size, f.is_folder
-			FROM share_links sl
-			JOIN files f ON sl.file_id = f.id
-			WHERE sl.token=$1`,
-			token).Scan(&shareLink.ID, &fileID, &shareLink.UserID, &shareLink.ExpiresAt,
-			&storedPassword, &filePath, &fileName, &fileSize, &isFolder)
+// openShare resolves the :token read link and checks its expiry and, for a
+// password-protected link, the access token issued by UnlockShare. When
+// access is refused it writes the response itself and returns nil with the
+// result of writing it.
+func openShare(repo *repository.Repository, c *fiber.Ctx) (*repository.SharedFile, error) {
+	return openShareKind(repo, c, models.ShareKindRead)
+}
 
-		if err != nil {
-			return c.Status(404).JSON(fiber.Map{"error": "Share link not found"})
-		}
+// openShareKind is openShare for a link of the given kind; links of the
+// other kind are refused, so a file request never exposes its folder
+func openShareKind(repo *repository.Repository, c *fiber.Ctx, kind string) (*repository.SharedFile, error) {
+	token := c.Params("token")
 
-		// Check if expired
-		if shareLink.ExpiresAt != nil && shareLink.ExpiresAt.Before(time.Now()) {
-			return c.Status(410).JSON(fiber.Map{"error": "Share link has expired"})
+	// Get share link info
+	shared, err := repo.Shares.GetByToken(context.Background(), token)
+	if err != nil {
+		return nil, c.Status(404).JSON(fiber.Map{"error": "Share link not found"})
+	}
+	shareLink := shared.Share
+
+	if shareLink.Kind != kind {
+		denyShareAccess(repo, c, &shareLink, "wrong link type")
+		if kind == models.ShareKindRead {
+			return nil, c.Status(403).JSON(fiber.Map{"error": "This link only accepts uploads"})
 		}
+		return nil, c.Status(403).JSON(fiber.Map{"error": "This link does not accept uploads"})
+	}
 
-		// Check password if required
-		if storedPassword != nil {
-			if password == "" {
-				return c.Status(401).JSON(fiber.Map{
-					"error":             "Password required",
-					"passwordProtected": true,
-				})
-			}
+	// Revoke-on-change links stop working for good once the item changes
+	if shareLink.RevokedAt != nil {
+		denyShareAccess(repo, c, &shareLink, "revoked")
+		return nil, c.Status(410).JSON(fiber.Map{"error": "Share link has been revoked"})
+	}
 
-			if err := bcrypt.CompareHashAndPassword([]byte(*storedPassword), []byte(password)); err != nil {
-				return c.Status(401).JSON(fiber.Map{"error": "Invalid password"})
-			}
+	// Check if expired
+	if shareLink.ExpiresAt != nil && shareLink.ExpiresAt.Before(time.Now()) {
+		denyShareAccess(repo, c, &shareLink, "expired")
+		return nil, c.Status(410).JSON(fiber.Map{"error": "Share link has expired"})
+	}
+
+	// Used up links stop working altogether
+	if shareLink.MaxDownloads != nil && shareLink.DownloadCount >= *shareLink.MaxDownloads {
+		denyShareAccess(repo, c, &shareLink, "download limit reached")
+		return nil, c.Status(410).JSON(fiber.Map{"error": "Share link has reached its download limit"})
+	}
+
+	// The password is exchanged for an access token at /share/:token/unlock
+	if shareLink.Password != nil && !validShareAccess(c, &shareLink) {
+		denyShareAccess(repo, c, &shareLink, "password required")
+		return nil, c.Status(401).JSON(fiber.Map{
+			"error":             "Password required",
+			"passwordProtected": true,
+		})
+	}
+	return shared, nil
+}
+
+// GetSharedFile handles public access to shared files
+func GetSharedFile(repo *repository.Repository, store storage.Backend) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		shared, err := openShare(repo, c)
+		if shared == nil {
+			return err
 		}
+		file := &shared.File
 
 		// If it's a folder, return folder contents
-		if isFolder {
-			return getSharedFolderContents(conn, c, fileID)
+		if file.IsFolder {
+			return getSharedFolderContents(repo, c, &shared.Share, file, "")
 		}
 
 		// For files, stream the download
-		file, err := os.Open(filePath)
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to open file"})
-		}
-		defer file.Close()
-
-		c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
-		c.Set("Content-Type", "application/octet-stream")
-		c.Set("Content-Length", fmt.Sprintf("%d", fileSize))
-
-		return c.SendStream(file)
+		return serveSharedFile(repo, c, store, &shared.Share, file)
 	}
 }
 
-// getSharedFolderContents returns the contents of a shared folder
-func getSharedFolderContents(conn *pgx.Conn, c *fiber.Ctx, folderID string) error {
-	rows, err := conn.Query(context.Background(),
-		`SELECT id, file_name, original_name, file_size, is_folder, created_at
-		FROM files WHERE parent_id=$1 ORDER BY is_folder DESC, original_name ASC`,
-		folderID)
+// serveSharedFile streams a file inside a share, or the version a pinned
+// link is pinned to, recording it in the access log. Only a response that
+// starts the content from its first byte counts against the share's
+// download limit.
+func serveSharedFile(repo *repository.Repository, c *fiber.Ctx, store storage.Backend, share *models.ShareLink, file *models.File) error {
+	d, err := sharedDownload(repo, share, file)
+	if err == pgx.ErrNoRows {
+		denyShareAccess(repo, c, share, "pinned version unavailable")
+		return c.Status(410).JSON(fiber.Map{"error": "The shared version of this file is no longer available"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get file"})
+	}
+
+	d.Claim = func() (bool, error) { return claimShareDownload(repo, c, share) }
+	d.Sent = recordShareSent(repo, newShareAccess(c, share, file.ID, models.ShareActionDownload))
+	return serveDownload(c, store, d)
+}
 
+// getSharedFolderContents returns the contents of a folder inside a share,
+// at path relative to the shared folder, and records the view
+func getSharedFolderContents(repo *repository.Repository, c *fiber.Ctx, share *models.ShareLink, folder *models.File, path string) error {
+	files, err := repo.Files.ListChildren(context.Background(), folder.ID)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to get folder contents"})
 	}
-	defer rows.Close()
+	recordShareAccess(repo, newShareAccess(c, share, folder.ID, models.ShareActionView))
 
-	var files []models.File
-	for rows.Next() {
-		var f models.File
-		err := rows.Scan(&f.ID, &f.FileName, &f.OriginalName, &f.FileSize, &f.IsFolder, &f.CreatedAt)
-		if err != nil {
-			continue
+	return c.Status(200).JSON(fiber.Map{
+		"type":       "folder",
+		"folderID":   folder.ID,
+		"folderName": folder.OriginalName,
+		"path":       path,
+		"files":      files,
+	})
+}
+
+// BrowseSharedFolder lists a folder inside a shared folder, addressed by
+// ?path= relative to it (e.g. "photos/2024"). The path is resolved one name
+// at a time from the shared folder, so it can't reach outside the share.
+func BrowseSharedFolder(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		shared, err := openShare(repo, c)
+		if shared == nil {
+			return err
+		}
+		if !shared.File.IsFolder {
+			return c.Status(400).JSON(fiber.Map{"error": "Shared item is not a folder"})
+		}
+
+		folder := &shared.File
+		var segments []string
+		for _, name := range strings.Split(c.Query("path"), "/") {
+			if name == "" {
+				continue
+			}
+			child, err := repo.Files.FindChildFolder(context.Background(), folder.ID, name)
+			if err == pgx.ErrNoRows {
+				return c.Status(404).JSON(fiber.Map{"error": "Folder not found"})
+			}
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to get folder contents"})
+			}
+			folder = child
+			segments = append(segments, name)
 		}
-		files = append(files, f)
+
+		return getSharedFolderContents(repo, c, &shared.Share, folder, strings.Join(segments, "/"))
 	}
+}
 
-	return c.Status(200).JSON(fiber.Map{
-		"type":     "folder",
-		"folderID": folderID,
-		"files":    files,
-	})
+// GetSharedItem downloads a file inside a share, or lists a folder inside
+// it, after checking that the item is the shared item or one of its
+// descendants
+func GetSharedItem(repo *repository.Repository, store storage.Backend) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		shared, err := openShare(repo, c)
+		if shared == nil {
+			return err
+		}
+
+		item, err := repo.Files.GetWithin(context.Background(), c.Params("fileId"), shared.File.ID)
+		if err == pgx.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get file"})
+		}
+
+		if item.IsFolder {
+			return getSharedFolderContents(repo, c, &shared.Share, item, "")
+		}
+		return serveSharedFile(repo, c, store, &shared.Share, item)
+	}
 }
 
 // GetShareInfo returns information about a share link without downloading
-func GetShareInfo(conn *pgx.Conn) fiber.Handler {
+func GetShareInfo(repo *repository.Repository) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		token := c.Params("token")
 
-		var fileName string
-		var fileSize int64
-		var isFolder bool
-		var expiresAt *time.Time
-		var hasPassword bool
-		var createdAt time.Time
-
-		err := conn.QueryRow(context.Background(),
-			`SELECT f.original_name, f.file_size, f.is_folder, sl.expires_at, 
-			(sl.password IS NOT NULL) as has_password, sl.created_at
-			FROM share_links sl
-			JOIN files f ON sl.file_id = f.id
-			WHERE sl.token=$1`,
-			token).Scan(&fileName, &fileSize, &isFolder, &expiresAt, &hasPassword, &createdAt)
-
+		shared, err := repo.Shares.GetByToken(context.Background(), token)
 		if err != nil {
 			return c.Status(404).JSON(fiber.Map{"error": "Share link not found"})
 		}
+		expiresAt := shared.Share.ExpiresAt
+
+		if shared.Share.RevokedAt != nil {
+			return c.Status(410).JSON(fiber.Map{"error": "Share link has been revoked"})
+		}
 
 		// Check if expired
 		if expiresAt != nil && expiresAt.Before(time.Now()) {
 			return c.Status(410).JSON(fiber.Map{"error": "Share link has expired"})
 		}
 
-		return c.Status(200).JSON(fiber.Map{
-			"fileName":          fileName,
-			"fileSize":          fileSize,
-			"isFolder":          isFolder,
+		info := fiber.Map{
+			"type":              shared.Share.Kind,
+			"fileName":          shared.File.OriginalName,
+			"fileSize":          shared.File.FileSize,
+			"isFolder":          shared.File.IsFolder,
 			"expiresAt":         expiresAt,
-			"passwordProtected": hasPassword,
-			"createdAt":         createdAt,
-		})
+			"passwordProtected": shared.Share.Password != nil,
+			"createdAt":         shared.Share.CreatedAt,
+		}
+		// Pinned links describe the version they serve
+		if shared.Share.OnChange == models.ShareOnChangePin && !shared.File.IsFolder {
+			d, err := sharedDownload(repo, &shared.Share, &shared.File)
+			if err == pgx.ErrNoRows {
+				return c.Status(410).JSON(fiber.Map{"error": "The shared version of this file is no longer available"})
+			}
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to get share info"})
+			}
+			info["fileSize"] = d.Size
+			info["pinnedVersion"] = shared.Share.PinnedVersion
+		}
+		if limit := shared.Share.MaxDownloads; limit != nil {
+			info["maxDownloads"] = *limit
+			info["downloadsRemaining"] = max(*limit-shared.Share.DownloadCount, 0)
+		}
+		// File requests tell uploaders what they may send
+		if shared.Share.Kind == models.ShareKindUpload {
+			info["maxFileSize"] = shared.Share.MaxFileSize
+			info["allowedExtensions"] = shared.Share.AllowedExtensions
+			info["requireUploaderInfo"] = shared.Share.RequireUploaderInfo
+		}
+		return c.Status(200).JSON(info)
 	}
 }
 
 // ListUserShares lists all share links created by a user
-func ListUserShares(conn *pgx.Conn) fiber.Handler {
+func ListUserShares(repo *repository.Repository) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		userID := c.Locals("userID").(string)
 
-		rows, err := conn.Query(context.Background(),
-			`SELECT sl.id, sl.token, sl.expires_at, sl.created_at,
-			f.id, f.original_name, f.is_folder, (sl.password IS NOT NULL) as has_password
-			FROM share_links sl
-			JOIN files f ON sl.file_id = f.id
-			WHERE sl.user_id=$1
-			ORDER BY sl.created_at DESC`,
-			userID)
-
+		userShares, err := repo.Shares.ListByUser(context.Background(), userID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get shares"})
+		}
+		stats, err := repo.Shares.StatsByUser(context.Background(), userID)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to get shares"})
 		}
-		defer rows.Close()
 
 		type ShareInfo struct {
 			ID                string     `json:"id"`
 			Token             string     `json:"token"`
+			Type              string     `json:"type"`
 			FileID            string     `json:"fileId"`
 			FileName          string     `json:"fileName"`
 			IsFolder          bool       `json:"isFolder"`
@@ -265,23 +458,51 @@ func ListUserShares(conn *pgx.Conn) fiber.Handler {
 			PasswordProtected bool       `json:"passwordProtected"`
 			CreatedAt         time.Time  `json:"createdAt"`
 			ShareURL          string     `json:"shareUrl"`
-		}
 
-		var shares []ShareInfo
-		baseURL := os.Getenv("BASE_URL")
-		if baseURL == "" {
-			baseURL = fmt.Sprintf("http://localhost:%s", os.Getenv("PORT"))
+			// File request limits
+			MaxFileSize         *int64   `json:"maxFileSize,omitempty"`
+			AllowedExtensions   []string `json:"allowedExtensions,omitempty"`
+			RequireUploaderInfo bool     `json:"requireUploaderInfo,omitempty"`
+
+			MaxDownloads  *int              `json:"maxDownloads,omitempty"`
+			DownloadCount int               `json:"downloadCount"`
+			Stats         models.ShareStats `json:"stats"` // From the access log
+
+			OnChange      string     `json:"onChange"`
+			PinnedVersion *int       `json:"pinnedVersion,omitempty"`
+			RevokedAt     *time.Time `json:"revokedAt,omitempty"`
+			RevokedReason string     `json:"revokedReason,omitempty"`
 		}
 
-		for rows.Next() {
-			var s ShareInfo
-			err := rows.Scan(&s.ID, &s.Token, &s.ExpiresAt, &s.CreatedAt,
-				&s.FileID, &s.FileName, &s.IsFolder, &s.PasswordProtected)
-			if err != nil {
-				continue
-			}
-			s.ShareURL = fmt.Sprintf("%s/share/%s", baseURL, s.Token)
-			shares = append(shares, s)
+		var shares []ShareInfo
+		baseURL := publicBaseURL()
+
+		for _, us := range userShares {
+			shares = append(shares, ShareInfo{
+				ID:                us.Share.ID,
+				Token:             us.Share.Token,
+				Type:              us.Share.Kind,
+				FileID:            us.File.ID,
+				FileName:          us.File.OriginalName,
+				IsFolder:          us.File.IsFolder,
+				ExpiresAt:         us.Share.ExpiresAt,
+				PasswordProtected: us.Share.Password != nil,
+				CreatedAt:         us.Share.CreatedAt,
+				ShareURL:          fmt.Sprintf("%s/share/%s", baseURL, us.Share.Token),
+
+				MaxFileSize:         us.Share.MaxFileSize,
+				AllowedExtensions:   us.Share.AllowedExtensions,
+				RequireUploaderInfo: us.Share.RequireUploaderInfo,
+
+				MaxDownloads:  us.Share.MaxDownloads,
+				DownloadCount: us.Share.DownloadCount,
+				Stats:         stats[us.Share.ID],
+
+				OnChange:      us.Share.OnChange,
+				PinnedVersion: us.Share.PinnedVersion,
+				RevokedAt:     us.Share.RevokedAt,
+				RevokedReason: us.Share.RevokedReason,
+			})
 		}
 
 		return c.Status(200).JSON(shares)
@@ -289,70 +510,86 @@ func ListUserShares(conn *pgx.Conn) fiber.Handler {
 }
 
 // DeleteShareLink deletes a share link
-func DeleteShareLink(conn *pgx.Conn) fiber.Handler {
+func DeleteShareLink(repo *repository.Repository) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		shareID := c.Params("shareId")
 		userID := c.Locals("userID").(string)
 
-		// Get file_id before deleting
-		var fileID string
-		err := conn.QueryRow(context.Background(),
-			`SELECT file_id FROM share_links WHERE id=$1 AND user_id=$2`,
-			shareID, userID).Scan(&fileID)
+		err := repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+			// Get file_id before deleting
+			share, err := tx.Shares.GetOwned(context.Background(), shareID, userID)
+			if err != nil {
+				return err
+			}
 
-		if err != nil {
-			return c.Status(404).JSON(fiber.Map{"error": "Share link not found"})
-		}
+			// Delete share link
+			if err := tx.Shares.Delete(context.Background(), shareID, userID); err != nil {
+				return err
+			}
 
-		// Delete share link
-		_, err = conn.Exec(context.Background(),
-			`DELETE FROM share_links WHERE id=$1 AND user_id=$2`,
-			shareID, userID)
+			// Check if file has any other shares
+			otherShares, err := tx.Shares.CountForFile(context.Background(), share.FileID)
+			if err != nil {
+				return err
+			}
 
+			// If no other shares, mark file as not shared
+			if otherShares == 0 {
+				return tx.Files.SetShared(context.Background(), share.FileID, false)
+			}
+			return nil
+		})
+
+		if err == pgx.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Share link not found"})
+		}
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to delete share link"})
 		}
 
-		// Check if file has any other shares
-		var otherShares int
-		conn.QueryRow(context.Background(),
-			`SELECT COUNT(*) FROM share_links WHERE file_id=$1`, fileID).Scan(&otherShares)
-
-		// If no other shares, mark file as not shared
-		if otherShares == 0 {
-			conn.Exec(context.Background(),
-				`UPDATE files SET is_shared = false WHERE id=$1`, fileID)
-		}
-
 		return c.Status(200).JSON(fiber.Map{"message": "Share link deleted successfully"})
 	}
 }
 
 // UpdateShareLink updates a share link (extend expiration or change password)
-func UpdateShareLink(conn *pgx.Conn) fiber.Handler {
+func UpdateShareLink(repo *repository.Repository) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		shareID := c.Params("shareId")
 		userID := c.Locals("userID").(string)
 
 		req := struct {
-			ExpiresIn *int    `json:"expiresIn"` // Hours to extend
-			Password  *string `json:"password"`  // New password (empty string to remove)
+			ExpiresIn    *int    `json:"expiresIn"`    // Hours to extend
+			Password     *string `json:"password"`     // New password (empty string to remove)
+			MaxDownloads *int    `json:"maxDownloads"` // Total downloads allowed (0 to remove the limit)
 		}{}
 
 		if err := c.BodyParser(&req); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 		}
+		if req.MaxDownloads != nil && *req.MaxDownloads < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "maxDownloads must not be negative"})
+		}
 
 		// Verify share exists and belongs to user
-		var exists bool
-		err := conn.QueryRow(context.Background(),
-			`SELECT EXISTS(SELECT 1 FROM share_links WHERE id=$1 AND user_id=$2)`,
-			shareID, userID).Scan(&exists)
-
-		if err != nil || !exists {
+		share, err := repo.Shares.GetOwned(context.Background(), shareID, userID)
+		if err != nil {
 			return c.Status(404).JSON(fiber.Map{"error": "Share link not found"})
 		}
 
+		// Update the download limit if provided; downloads already made still count
+		if req.MaxDownloads != nil {
+			if share.Kind != models.ShareKindRead {
+				return c.Status(400).JSON(fiber.Map{"error": "Download limits only apply to read links"})
+			}
+			var maxDownloads *int
+			if *req.MaxDownloads > 0 {
+				maxDownloads = req.MaxDownloads
+			}
+			if err := repo.Shares.SetMaxDownloads(context.Background(), shareID, maxDownloads); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to update download limit"})
+			}
+		}
+
 		// Update expiration if provided
 		if req.ExpiresIn != nil {
 			var expiresAt *time.Time
@@ -361,9 +598,7 @@ func UpdateShareLink(conn *pgx.Conn) fiber.Handler {
 				expiresAt = &expiry
 			}
 
-			_, err = conn.Exec(context.Background(),
-				`UPDATE share_links SET expires_at=$1 WHERE id=$2`,
-				expiresAt, shareID)
+			err = repo.Shares.SetExpiry(context.Background(), shareID, expiresAt)
 
 			if err != nil {
 				return c.Status(500).JSON(fiber.Map{"error": "Failed to update expiration"})
@@ -382,9 +617,7 @@ func UpdateShareLink(conn *pgx.Conn) fiber.Handler {
 				hashedPassword = &hashStr
 			}
 
-			_, err = conn.Exec(context.Background(),
-				`UPDATE share_links SET password=$1 WHERE id=$2`,
-				hashedPassword, shareID)
+			err = repo.Shares.SetPassword(context.Background(), shareID, hashedPassword)
 
 			if err != nil {
 				return c.Status(500).JSON(fiber.Map{"error": "Failed to update password"})
@@ -394,4 +627,3 @@ func UpdateShareLink(conn *pgx.Conn) fiber.Handler {
 		return c.Status(200).JSON(fiber.Map{"message": "Share link updated successfully"})
 	}
 }
-
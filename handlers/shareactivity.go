@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+	"github.com/pk0205/dropbox-2.0/repository"
+)
+
+const (
+	maxUserAgentLength  = 512  // Longer User-Agent headers are cut in the access log
+	maxActivityPageSize = 1000 // Most access log entries returned at once
+)
+
+// newShareAccess starts a successful access log entry for the request's
+// client. Everything is copied out of the request, so the entry can be
+// recorded after the handler has returned.
+func newShareAccess(c *fiber.Ctx, share *models.ShareLink, fileID, action string) *models.ShareAccess {
+	userAgent := strings.Clone(c.Get(fiber.HeaderUserAgent))
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	entry := &models.ShareAccess{
+		ID:        uuid.New().String(),
+		ShareID:   share.ID,
+		Action:    action,
+		Outcome:   models.ShareOutcomeSuccess,
+		IP:        c.IP(),
+		UserAgent: userAgent,
+		CreatedAt: time.Now(),
+	}
+	if fileID != "" {
+		entry.FileID = &fileID
+	}
+	return entry
+}
+
+// recordShareAccess writes an access log entry. The log is for auditing
+// and a failure to write it doesn't fail the request.
+func recordShareAccess(repo *repository.Repository, entry *models.ShareAccess) {
+	if err := repo.Shares.LogAccess(context.Background(), entry); err != nil {
+		log.Printf("share %s: failed to log access: %v", entry.ShareID, err)
+	}
+}
+
+// denyShareAccess records that the request was refused for the reason
+func denyShareAccess(repo *repository.Repository, c *fiber.Ctx, share *models.ShareLink, reason string) {
+	entry := newShareAccess(c, share, "", models.ShareActionAccess)
+	entry.Outcome = models.ShareOutcomeDenied
+	entry.Reason = reason
+	recordShareAccess(repo, entry)
+}
+
+// recordShareSent returns a callback for download.Sent and streamArchive
+// that records entry once the response is over, with the bytes served.
+// Error responses are recorded as denied with their status text.
+func recordShareSent(repo *repository.Repository, entry *models.ShareAccess) func(int, int64) {
+	return func(status int, bytes int64) {
+		entry.BytesServed = bytes
+		if status >= 400 {
+			entry.Outcome = models.ShareOutcomeDenied
+			entry.Reason = http.StatusText(status)
+		}
+		recordShareAccess(repo, entry)
+	}
+}
+
+// claimShareDownload counts a download against the share's download limit.
+// When the limit has been reached it records the refusal and writes the
+// response itself, returning false with the result of writing it.
+func claimShareDownload(repo *repository.Repository, c *fiber.Ctx, share *models.ShareLink) (bool, error) {
+	err := repo.Shares.ClaimDownload(context.Background(), share.ID)
+	if err == pgx.ErrNoRows {
+		denyShareAccess(repo, c, share, "download limit reached")
+		return false, c.Status(410).JSON(fiber.Map{"error": "Share link has reached its download limit"})
+	}
+	if err != nil {
+		return false, c.Status(500).JSON(fiber.Map{"error": "Failed to start download"})
+	}
+	return true, nil
+}
+
+// GetShareActivity returns the access log of one of the user's share links,
+// newest first. Pages hold ?limit= entries (100 by default); pass the
+// createdAt of the last entry as ?before= for the next page.
+func GetShareActivity(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		shareID := c.Params("shareId")
+		userID := c.Locals("userID").(string)
+
+		share, err := repo.Shares.GetOwned(context.Background(), shareID, userID)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Share link not found"})
+		}
+
+		limit := c.QueryInt("limit", 100)
+		if limit < 1 || limit > maxActivityPageSize {
+			return c.Status(400).JSON(fiber.Map{"error": "limit must be between 1 and 1000"})
+		}
+		before := time.Now()
+		if value := c.Query("before"); value != "" {
+			if before, err = time.Parse(time.RFC3339Nano, value); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "before must be an RFC 3339 timestamp"})
+			}
+		}
+
+		activity, err := repo.Shares.ListAccess(context.Background(), shareID, before, limit)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get share activity"})
+		}
+		if activity == nil {
+			activity = []models.ShareAccess{}
+		}
+
+		return c.Status(200).JSON(fiber.Map{
+			"shareId":       share.ID,
+			"maxDownloads":  share.MaxDownloads,
+			"downloadCount": share.DownloadCount,
+			"activity":      activity,
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+	"github.com/pk0205/dropbox-2.0/repository"
+)
+
+// Changes that revoke revoke-on-change share links, as they read in the
+// link's revocation reason after the item's name
+const (
+	changeModified = "was modified"
+	changeTrashed  = "was moved to the trash"
+	changeMovedOut = "was moved out of the shared folder"
+)
+
+// sharedDownload is what share serves for file: its current content or,
+// when share is pinned to a version of it, that version. A pinned version
+// that is gone or whose content no longer matches is pgx.ErrNoRows.
+func sharedDownload(repo *repository.Repository, share *models.ShareLink, file *models.File) (download, error) {
+	d := fileDownload(file)
+	if share.OnChange != models.ShareOnChangePin || share.FileID != file.ID || share.PinnedVersion == nil {
+		return d, nil
+	}
+
+	version, checksum := file.Version, file.Checksum
+	if *share.PinnedVersion != file.Version {
+		v, err := repo.Versions.Get(context.Background(), file.ID, *share.PinnedVersion)
+		if err != nil {
+			return d, err
+		}
+		d.Key, d.Size, d.Checksum, d.ModTime = contentKey(v.BlobID, v.FilePath), v.FileSize, v.Checksum, v.CreatedAt
+		version, checksum = v.VersionNum, v.Checksum
+	}
+	if version != *share.PinnedVersion || share.PinnedChecksum == nil || checksum != *share.PinnedChecksum {
+		return d, pgx.ErrNoRows
+	}
+	return d, nil
+}
+
+// revokeSharesOnChange revokes the revoke-on-change links affected by a
+// change to file: links on it or a folder above it and, when it goes to the
+// trash, on anything inside it. Their owners are notified. It runs in the
+// transaction making the change, before the item goes to the trash.
+func revokeSharesOnChange(tx *repository.Repository, file *models.File, change string) error {
+	reason := fmt.Sprintf("%q %s", file.OriginalName, change)
+	revoked, err := tx.Shares.RevokeOnChange(context.Background(), file.ID, change == changeTrashed, reason)
+	if err != nil {
+		return err
+	}
+	return notifyRevokedShares(tx, revoked, reason)
+}
+
+// revokeSharesOnMoveOut revokes the revoke-on-change links on the folders
+// file leaves by moving to parentID and notifies their owners. It runs in
+// the transaction making the move, before the item is moved.
+func revokeSharesOnMoveOut(tx *repository.Repository, file *models.File, parentID *string) error {
+	reason := fmt.Sprintf("%q %s", file.OriginalName, changeMovedOut)
+	revoked, err := tx.Shares.RevokeOnMoveOut(context.Background(), file.ID, parentID, reason)
+	if err != nil {
+		return err
+	}
+	return notifyRevokedShares(tx, revoked, reason)
+}
+
+// notifyRevokedShares tells the owners of revoked links why they stopped working
+func notifyRevokedShares(tx *repository.Repository, revoked []repository.SharedFile, reason string) error {
+	for _, shared := range revoked {
+		err := tx.Notifications.Create(context.Background(), &models.Notification{
+			ID:        uuid.New().String(),
+			UserID:    shared.Share.UserID,
+			Kind:      models.NotificationShareRevoked,
+			Message:   fmt.Sprintf("Share link to %q was revoked: %s", shared.File.OriginalName, reason),
+			ShareID:   &shared.Share.ID,
+			FileID:    &shared.File.ID,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
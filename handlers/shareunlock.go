@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+	"github.com/pk0205/dropbox-2.0/repository"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// ShareAccessCookie holds the access token for a password-protected
+	// share, scoped to the share's /share/<token> path
+	ShareAccessCookie = "ShareAccess"
+	// ShareAccessHeader carries the access token for clients without cookies
+	ShareAccessHeader = "X-Share-Access"
+)
+
+// UnlockPolicy throttles share password attempts and sets how long an
+// unlocked share stays unlocked
+type UnlockPolicy struct {
+	TokenAttempts int           // Failures allowed per share link within Window
+	IPAttempts    int           // Failures allowed per client address within Window, across links
+	Window        time.Duration // How long failures are counted
+	Lockout       time.Duration // How long a link or address is locked out after too many failures
+	AccessTTL     time.Duration // Lifetime of the access token issued on success
+}
+
+// passwordFingerprint identifies the password a share had when an access
+// token was issued, so changing or removing it revokes earlier tokens
+func passwordFingerprint(share *models.ShareLink) string {
+	if share.Password == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(*share.Password))
+	return hex.EncodeToString(sum[:8])
+}
+
+// newShareAccessToken signs a token unlocking share until expiresAt
+func newShareAccessToken(share *models.ShareLink, expiresAt time.Time) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":   share.ID,
+		"scope": "share",
+		"pwd":   passwordFingerprint(share),
+		"exp":   expiresAt.Unix(),
+	})
+	return token.SignedString([]byte(os.Getenv("SECRET_KEY")))
+}
+
+// validShareAccess reports whether the request carries an unexpired access
+// token for share, issued under its current password
+func validShareAccess(c *fiber.Ctx, share *models.ShareLink) bool {
+	tokenString := c.Cookies(ShareAccessCookie)
+	if tokenString == "" {
+		tokenString = c.Get(ShareAccessHeader)
+	}
+	if tokenString == "" {
+		return false
+	}
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(os.Getenv("SECRET_KEY")), nil
+	}, jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		return false
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	return ok && claims["scope"] == "share" && claims["sub"] == share.ID &&
+		claims["pwd"] == passwordFingerprint(share)
+}
+
+// UnlockShare checks the password of a protected share link and, when it is
+// right, issues a short-lived access token as a cookie scoped to the link
+// (and in the response, for the X-Share-Access header). Failed attempts are
+// counted per link and per client address; too many lock further attempts
+// out for a while, even with the right password.
+func UnlockShare(repo *repository.Repository, policy UnlockPolicy) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token := c.Params("token")
+
+		req := struct {
+			Password string `json:"password"`
+		}{}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+
+		shared, err := repo.Shares.GetByToken(context.Background(), token)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Share link not found"})
+		}
+		share := &shared.Share
+
+		if share.RevokedAt != nil {
+			denyShareAccess(repo, c, share, "revoked")
+			return c.Status(410).JSON(fiber.Map{"error": "Share link has been revoked"})
+		}
+		if share.ExpiresAt != nil && share.ExpiresAt.Before(time.Now()) {
+			denyShareAccess(repo, c, share, "expired")
+			return c.Status(410).JSON(fiber.Map{"error": "Share link has expired"})
+		}
+		if share.Password == nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Share link is not password protected"})
+		}
+
+		// The attempt is counted as a failure before the password is
+		// compared, so concurrent guesses can't all pass the limit check
+		shareKey, ipKey := "share:"+share.ID, "ip:"+c.IP()
+		now := time.Now()
+		lockUntil := now.Add(policy.Lockout)
+		shareAttempts, lockedUntil, err := repo.Shares.ReserveUnlockAttempt(context.Background(), shareKey, now.Add(-policy.Window), policy.TokenAttempts, lockUntil)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to check password"})
+		}
+		if lockedUntil != nil {
+			denyShareAccess(repo, c, share, "locked out")
+			return tooManyAttempts(c, *lockedUntil)
+		}
+		ipAttempts, lockedUntil, err := repo.Shares.ReserveUnlockAttempt(context.Background(), ipKey, now.Add(-policy.Window), policy.IPAttempts, lockUntil)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to check password"})
+		}
+		if lockedUntil != nil {
+			if err := repo.Shares.ReleaseUnlockAttempt(context.Background(), shareKey); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to check password"})
+			}
+			denyShareAccess(repo, c, share, "locked out")
+			return tooManyAttempts(c, *lockedUntil)
+		}
+
+		if req.Password == "" || bcrypt.CompareHashAndPassword([]byte(*share.Password), []byte(req.Password)) != nil {
+			denyShareAccess(repo, c, share, "invalid password")
+
+			// The failure that reaches a limit locks its key straight away
+			shareLocked, ipLocked := shareAttempts >= policy.TokenAttempts, ipAttempts >= policy.IPAttempts
+			if shareLocked {
+				if err := repo.Shares.LockUnlockAttempts(context.Background(), shareKey, lockUntil); err != nil {
+					return c.Status(500).JSON(fiber.Map{"error": "Failed to check password"})
+				}
+			}
+			if ipLocked {
+				if err := repo.Shares.LockUnlockAttempts(context.Background(), ipKey, lockUntil); err != nil {
+					return c.Status(500).JSON(fiber.Map{"error": "Failed to check password"})
+				}
+			}
+			if shareLocked || ipLocked {
+				return tooManyAttempts(c, lockUntil)
+			}
+			return c.Status(401).JSON(fiber.Map{"error": "Invalid password"})
+		}
+
+		// Earlier failures from this address still count towards its own limit
+		if err := repo.Shares.ClearUnlockFailures(context.Background(), shareKey); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to check password"})
+		}
+		if err := repo.Shares.ReleaseUnlockAttempt(context.Background(), ipKey); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to check password"})
+		}
+
+		expiresAt := time.Now().Add(policy.AccessTTL)
+		if share.ExpiresAt != nil && share.ExpiresAt.Before(expiresAt) {
+			expiresAt = *share.ExpiresAt
+		}
+		accessToken, err := newShareAccessToken(share, expiresAt)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to generate token"})
+		}
+
+		c.Cookie(&fiber.Cookie{
+			Name:     ShareAccessCookie,
+			Value:    accessToken,
+			Expires:  expiresAt,
+			HTTPOnly: true,
+			SameSite: "Lax",
+			Path:     "/share/" + token,
+		})
+		recordShareAccess(repo, newShareAccess(c, share, "", models.ShareActionUnlock))
+
+		return c.Status(200).JSON(fiber.Map{
+			"message":     "Share unlocked",
+			"accessToken": accessToken,
+			"expiresAt":   expiresAt,
+		})
+	}
+}
+
+// tooManyAttempts is the response while password attempts are locked out
+func tooManyAttempts(c *fiber.Ctx, lockedUntil time.Time) error {
+	retryAfter := int(time.Until(lockedUntil).Seconds()) + 1
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	return c.Status(429).JSON(fiber.Map{
+		"error":      "Too many password attempts, try again later",
+		"retryAfter": retryAfter,
+	})
+}
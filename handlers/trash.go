@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/repository"
+)
+
+// ListTrash lists the items the user has deleted, most recent first
+func ListTrash(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(string)
+
+		files, err := repo.Files.ListTrash(context.Background(), userID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get trash"})
+		}
+
+		return c.Status(200).JSON(fiber.Map{
+			"files": files,
+			"count": len(files),
+		})
+	}
+}
+
+// RestoreFile takes an item out of the trash along with everything that was
+// deleted with it. Items whose folder is gone are restored to the root, and
+// an item whose name has been taken there meanwhile is renamed like an upload.
+func RestoreFile(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fileID := c.Params("fileId")
+		userID := c.Locals("userID").(string)
+
+		var movedToRoot bool
+		var name string
+		err := repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+			if err := tx.Files.LockTree(context.Background(), userID); err != nil {
+				return err
+			}
+			if _, err := tx.Files.GetTrashedForUpdate(context.Background(), fileID, userID); err != nil {
+				return err
+			}
+
+			var err error
+			movedToRoot, err = tx.Files.Restore(context.Background(), fileID)
+			if err != nil {
+				return err
+			}
+
+			restored, err := tx.Files.Get(context.Background(), fileID, userID)
+			if err != nil {
+				return err
+			}
+			name, err = resolveName(tx, userID, restored.ParentID, restored.OriginalName, restored.ID, restored.IsFolder, onConflictRename)
+			if err != nil || name == restored.OriginalName {
+				return err
+			}
+			return tx.Files.Move(context.Background(), restored.ID, name, restored.ParentID)
+		})
+
+		if err == pgx.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found in trash"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to restore file"})
+		}
+
+		return c.Status(200).JSON(fiber.Map{
+			"message":     "File restored successfully",
+			"fileId":      fileID,
+			"name":        name,
+			"movedToRoot": movedToRoot,
+		})
+	}
+}
+
+// DeleteFromTrash permanently deletes a trashed item
+func DeleteFromTrash(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fileID := c.Params("fileId")
+		userID := c.Locals("userID").(string)
+
+		err := repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+			return tx.PurgeTrashed(context.Background(), fileID, userID, nil)
+		})
+
+		if err == pgx.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found in trash"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to delete file"})
+		}
+
+		return c.Status(200).JSON(fiber.Map{"message": "File permanently deleted"})
+	}
+}
+
+// EmptyTrash permanently deletes everything in the user's trash
+func EmptyTrash(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(string)
+
+		deleted := 0
+		err := repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+			files, err := tx.Files.ListTrash(context.Background(), userID)
+			if err != nil {
+				return err
+			}
+			for _, f := range files {
+				// An earlier purge in this loop may already have removed it
+				// through its folder
+				if err := tx.PurgeTrashed(context.Background(), f.ID, userID, nil); err != nil && err != pgx.ErrNoRows {
+					return err
+				}
+			}
+			deleted = len(files)
+			return nil
+		})
+
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to empty trash"})
+		}
+
+		return c.Status(200).JSON(fiber.Map{
+			"message": "Trash emptied",
+			"deleted": deleted,
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+	"github.com/pk0205/dropbox-2.0/repository"
+	"github.com/pk0205/dropbox-2.0/storage"
+)
+
+// tus 1.0 (https://tus.io/protocols/resumable-upload) on top of chunk_uploads.
+// Each PATCH is stored as the next chunk of the session, so completed tus
+// uploads are assembled exactly like chunked ones.
+const (
+	tusVersion             = "1.0.0"
+	tusExtensions          = "creation,expiration,checksum,termination"
+	tusChecksumAlgorithms  = "sha1,sha256,md5"
+	tusOffsetContentType   = "application/offset+octet-stream"
+	tusStatusChecksumError = 460 // Checksum Mismatch, defined by the checksum extension
+)
+
+var (
+	errInvalidChecksum     = errors.New("invalid Upload-Checksum")
+	errUnsupportedChecksum = errors.New("unsupported checksum algorithm")
+)
+
+// TusResumable checks the protocol version of every tus request and marks
+// every response with the version the server speaks
+func TusResumable() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set("Tus-Resumable", tusVersion)
+		if c.Method() != fiber.MethodOptions && c.Get("Tus-Resumable") != tusVersion {
+			c.Set("Tus-Version", tusVersion)
+			return c.Status(412).JSON(fiber.Map{"error": "Unsupported tus version"})
+		}
+		return c.Next()
+	}
+}
+
+// TusOptions advertises the supported protocol version and extensions
+func TusOptions() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set("Tus-Version", tusVersion)
+		c.Set("Tus-Extension", tusExtensions)
+		c.Set("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+		return c.SendStatus(204)
+	}
+}
+
+// TusCreate starts an upload (creation extension). The file name comes from
+// the filename (or name) metadata and lands in the parentId folder, with
+// onConflict choosing how a taken name is handled; fileId metadata uploads a
+// new version of an existing file.
+func TusCreate(repo *repository.Repository, store storage.Backend) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(string)
+
+		length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid Upload-Length"})
+		}
+
+		metadata, err := parseTusMetadata(c.Get("Upload-Metadata"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid Upload-Metadata"})
+		}
+
+		fileName := metadata["filename"]
+		if fileName == "" {
+			fileName = metadata["name"]
+		}
+		target, err := newUploadTarget(repo, userID, metadata["fileId"], metadata["parentId"], fileName, metadata["onConflict"])
+		if err == errInvalidName {
+			return c.Status(400).JSON(fiber.Map{"error": "Missing or invalid filename metadata"})
+		}
+		if status, msg := uploadErrorStatus(err); status != 0 {
+			return c.Status(status).JSON(fiber.Map{"error": msg})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to initialize upload"})
+		}
+
+		upload := newUploadSession(uuid.New().String(), userID, target, "tus", &models.ChunkUpload{
+			TotalSize: length,
+			Metadata:  c.Get("Upload-Metadata"),
+			ExpiresAt: time.Now().Add(24 * time.Hour),
+		})
+
+		// The session reserves its length of the folder owner's quota
+		err = repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+			if err := checkQuota(tx, target.UserID, length, ""); err != nil {
+				return err
+			}
+			return tx.Uploads.Create(context.Background(), upload)
+		})
+		if err == errQuotaExceeded {
+			return quotaExceeded(c)
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to initialize upload"})
+		}
+
+		c.Set("Location", strings.TrimSuffix(c.Path(), "/")+"/"+upload.ID)
+		c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+
+		// Nothing will be PATCHed to an empty upload, so finish it right away
+		if length == 0 {
+			if err := repo.Uploads.StartAssembly(context.Background(), upload.ID, userID); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to save file"})
+			}
+			saved, err := finishUpload(repo, store, upload)
+			if status, msg := uploadErrorStatus(err); status != 0 {
+				return c.Status(status).JSON(fiber.Map{"error": msg})
+			}
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to save file"})
+			}
+			c.Set("X-File-Id", saved.FileID)
+		}
+
+		return c.SendStatus(201)
+	}
+}
+
+// TusHead reports how many bytes of an upload the server has
+func TusHead(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(string)
+
+		upload, err := repo.Uploads.Get(context.Background(), c.Params("uploadId"), userID)
+		if err != nil || upload.Protocol != "tus" {
+			return c.SendStatus(404)
+		}
+
+		c.Set("Cache-Control", "no-store")
+		switch {
+		case upload.Status == "completed" || upload.Status == "assembling":
+			c.Set("Upload-Offset", strconv.FormatInt(upload.TotalSize, 10))
+		case upload.Status == "failed" || upload.ExpiresAt.Before(time.Now()):
+			return c.SendStatus(410)
+		default:
+			c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+		}
+		c.Set("Upload-Length", strconv.FormatInt(upload.TotalSize, 10))
+		if upload.Metadata != "" {
+			c.Set("Upload-Metadata", upload.Metadata)
+		}
+
+		return c.SendStatus(200)
+	}
+}
+
+// TusPatch appends bytes at the current offset. The request that completes
+// the upload also turns it into a file, whose ID is returned in X-File-Id.
+func TusPatch(repo *repository.Repository, store storage.Backend) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		uploadID := c.Params("uploadId")
+		userID := c.Locals("userID").(string)
+
+		if c.Get("Content-Type") != tusOffsetContentType {
+			return c.Status(415).JSON(fiber.Map{"error": "Content-Type must be " + tusOffsetContentType})
+		}
+		offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid Upload-Offset"})
+		}
+
+		body := c.Body()
+		if header := c.Get("Upload-Checksum"); header != "" {
+			ok, err := verifyTusChecksum(header, body)
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+			}
+			if !ok {
+				return c.Status(tusStatusChecksumError).JSON(fiber.Map{"error": "Checksum mismatch"})
+			}
+		}
+
+		var upload *models.ChunkUpload
+		status := 0
+		err = repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+			// The row lock keeps concurrent PATCHes from writing the same part
+			upload, err = tx.Uploads.GetActiveForUpdate(context.Background(), uploadID, userID)
+			if err != nil {
+				return err
+			}
+			if upload.Protocol != "tus" {
+				return pgx.ErrNoRows
+			}
+			if offset != upload.Offset {
+				status = 409
+				return nil
+			}
+			if offset+int64(len(body)) > upload.TotalSize {
+				status = 413
+				return nil
+			}
+			if len(body) == 0 && upload.Offset < upload.TotalSize {
+				return nil
+			}
+
+			partNum := len(upload.UploadedChunks)
+			if _, err := store.Put(context.Background(), chunkKey(uploadID, partNum), bytes.NewReader(body)); err != nil {
+				return err
+			}
+			upload.Offset += int64(len(body))
+			upload.UploadedChunks = append(upload.UploadedChunks, partNum)
+			upload.TotalChunks = len(upload.UploadedChunks)
+			if err := tx.Uploads.AppendPart(context.Background(), uploadID, partNum, upload.Offset); err != nil {
+				return err
+			}
+
+			// The last part hands the session over to assembly
+			if upload.Offset == upload.TotalSize {
+				return tx.Uploads.StartAssembly(context.Background(), uploadID, userID)
+			}
+			return nil
+		})
+
+		if err == pgx.ErrNoRows {
+			if existing, err := repo.Uploads.Get(context.Background(), uploadID, userID); err == nil && existing.Protocol == "tus" {
+				return c.SendStatus(410)
+			}
+			return c.SendStatus(404)
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to save upload data"})
+		}
+		switch status {
+		case 409:
+			c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			return c.Status(409).JSON(fiber.Map{"error": "Upload-Offset does not match the current offset"})
+		case 413:
+			return c.Status(413).JSON(fiber.Map{"error": "Data exceeds Upload-Length"})
+		}
+
+		c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+
+		if upload.Offset == upload.TotalSize {
+			saved, err := finishUpload(repo, store, upload)
+			if status, msg := uploadErrorStatus(err); status != 0 {
+				return c.Status(status).JSON(fiber.Map{"error": msg})
+			}
+			if err == errUploadAbandoned {
+				return c.SendStatus(410)
+			}
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to save file"})
+			}
+			c.Set("X-File-Id", saved.FileID)
+		}
+
+		return c.SendStatus(204)
+	}
+}
+
+// TusDelete terminates an upload and discards the received data
+// (termination extension); see tusTermination for which sessions can be.
+func TusDelete(repo *repository.Repository, store storage.Backend) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		uploadID := c.Params("uploadId")
+		userID := c.Locals("userID").(string)
+
+		upload, err := repo.Uploads.Get(context.Background(), uploadID, userID)
+		if err != nil || upload.Protocol != "tus" {
+			return c.SendStatus(404)
+		}
+		if status := tusTermination(upload.Status); status != 204 {
+			return c.Status(status).JSON(fiber.Map{"error": "Upload can't be terminated while " + upload.Status})
+		}
+
+		// Only deleted if no PATCH has started assembling it since
+		err = repo.Uploads.Delete(context.Background(), uploadID, userID, upload.Status)
+		if err == pgx.ErrNoRows {
+			return c.Status(409).JSON(fiber.Map{"error": "Upload changed while being terminated"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to terminate upload"})
+		}
+		if upload.Status != "completed" {
+			storage.DeletePrefix(context.Background(), store, "chunks/"+uploadID+"/")
+		}
+
+		return c.SendStatus(204)
+	}
+}
+
+// tusTermination is the status TusDelete answers for a session in status:
+// 204 for pending and uploading sessions, whose chunks are discarded, and
+// 409 while assembling, as the assembly is still reading the chunks. A
+// completed session is forgotten with 204 but the file it created is kept;
+// it is deleted like any other file. Failed and expired sessions are
+// already being cleaned up (410).
+func tusTermination(status string) int {
+	switch status {
+	case "pending", "uploading", "completed":
+		return 204
+	case "assembling":
+		return 409
+	}
+	return 410
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// "key base64value" pairs, where the value may be omitted
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// verifyTusChecksum checks body against an Upload-Checksum header
+// ("<algorithm> <base64 digest>")
+func verifyTusChecksum(header string, body []byte) (bool, error) {
+	algorithm, encoded, _ := strings.Cut(header, " ")
+	expected, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false, errInvalidChecksum
+	}
+
+	var h hash.Hash
+	switch algorithm {
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	case "md5":
+		h = md5.New()
+	default:
+		return false, errUnsupportedChecksum
+	}
+	h.Write(body)
+	return bytes.Equal(h.Sum(nil), expected), nil
+}
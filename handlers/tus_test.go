@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{"one pair", "filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==", map[string]string{"filename": "world_domination_plan.pdf"}, false},
+		{"several pairs", "filename cmVwb3J0LnBkZg==,parentId Zm9sZGVyLTE=", map[string]string{"filename": "report.pdf", "parentId": "folder-1"}, false},
+		{"key without value", "is_confidential", map[string]string{"is_confidential": ""}, false},
+		{"spaces and empty entries", " filename cmVwb3J0LnBkZg== , ,onConflict cmVuYW1l", map[string]string{"filename": "report.pdf", "onConflict": "rename"}, false},
+		{"unicode value", "filename " + base64.StdEncoding.EncodeToString([]byte("résumé.pdf")), map[string]string{"filename": "résumé.pdf"}, false},
+		{"later key wins", "a MQ==,a Mg==", map[string]string{"a": "2"}, false},
+		{"bad base64", "filename not-base64!", nil, true},
+		{"unpadded base64", "filename cmVwb3J0LnBkZg", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTusMetadata(tt.header)
+			if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTusMetadata(%q) = %v, %v; want %v, error %v", tt.header, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyTusChecksum(t *testing.T) {
+	body := []byte("hello tus")
+	sha1Sum := sha1.Sum(body)
+	sha256Sum := sha256.Sum256(body)
+	encode := base64.StdEncoding.EncodeToString
+
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+		err    error
+	}{
+		{"sha1 match", "sha1 " + encode(sha1Sum[:]), true, nil},
+		{"sha256 match", "sha256 " + encode(sha256Sum[:]), true, nil},
+		{"sha256 mismatch", "sha256 " + encode(sha1Sum[:]), false, nil},
+		{"unsupported algorithm", "crc32 AAAAAA==", false, errUnsupportedChecksum},
+		{"bad base64", "sha1 %%%", false, errInvalidChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyTusChecksum(tt.header, body)
+			if got != tt.want || err != tt.err {
+				t.Errorf("verifyTusChecksum(%q) = %v, %v; want %v, %v", tt.header, got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestTusTermination(t *testing.T) {
+	tests := []struct {
+		status string
+		want   int
+	}{
+		{"pending", 204},
+		{"uploading", 204},
+		// The assembly is still reading the chunks
+		{"assembling", 409},
+		// Forgets the session, the file it created is kept
+		{"completed", 204},
+		{"failed", 410},
+		{"expired", 410},
+	}
+	for _, tt := range tests {
+		if got := tusTermination(tt.status); got != tt.want {
+			t.Errorf("tusTermination(%q) = %d; want %d", tt.status, got, tt.want)
+		}
+	}
+}
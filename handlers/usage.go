@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pk0205/dropbox-2.0/repository"
+)
+
+// errQuotaExceeded is returned when a change would take a user over their quota
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// checkQuota verifies that adding delta bytes keeps the user within their
+// quota. It locks the user row, so it must run inside the transaction that
+// records the change; excludeUploadID is a session whose reservation the
+// change replaces.
+func checkQuota(tx *repository.Repository, userID string, delta int64, excludeUploadID string) error {
+	quota, err := tx.Usage.LockQuota(context.Background(), userID)
+	if err != nil {
+		return err
+	}
+	if quota.Limit == nil || delta <= 0 {
+		return nil
+	}
+
+	used, err := tx.Usage.Used(context.Background(), userID)
+	if err != nil {
+		return err
+	}
+	reserved, err := tx.Usage.Reserved(context.Background(), userID, excludeUploadID)
+	if err != nil {
+		return err
+	}
+
+	if used+reserved+delta > *quota.Limit {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// quotaExceeded is the response for errQuotaExceeded
+func quotaExceeded(c *fiber.Ctx) error {
+	return c.Status(413).JSON(fiber.Map{"error": "Storage quota exceeded"})
+}
+
+// GetUsage reports the user's quota and how their storage is used, by
+// folder (the root or ?folderId=) and by file type
+func GetUsage(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(string)
+
+		var folderID *string
+		if id := c.Query("folderId"); id != "" {
+			folder, err := repo.Files.Get(context.Background(), id, userID)
+			if err != nil || !folder.IsFolder {
+				return c.Status(404).JSON(fiber.Map{"error": "Folder not found"})
+			}
+			folderID = &id
+		}
+
+		quota, err := repo.Usage.GetQuota(context.Background(), userID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get usage"})
+		}
+		used, err := repo.Usage.Used(context.Background(), userID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get usage"})
+		}
+		reserved, err := repo.Usage.Reserved(context.Background(), userID, "")
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get usage"})
+		}
+		trashed, err := repo.Usage.Trashed(context.Background(), userID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get usage"})
+		}
+		versions, err := repo.Usage.Versions(context.Background(), userID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get usage"})
+		}
+		byFolder, err := repo.Usage.ByFolder(context.Background(), userID, folderID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get usage"})
+		}
+		byType, err := repo.Usage.ByType(context.Background(), userID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get usage"})
+		}
+
+		var available *int64
+		if quota.Limit != nil {
+			left := max(*quota.Limit-used-reserved, 0)
+			available = &left
+		}
+
+		return c.Status(200).JSON(fiber.Map{
+			"plan":      quota.PlanID,
+			"planName":  quota.PlanName,
+			"quota":     quota.Limit,
+			"used":      used,
+			"reserved":  reserved,
+			"available": available,
+			"trash":     trashed,  // Included in used
+			"versions":  versions, // Not counted against the quota
+			"folderId":  folderID,
+			"byFolder":  byFolder,
+			"byType":    byType,
+		})
+	}
+}
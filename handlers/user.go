@@ -10,30 +10,21 @@ import (
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/pk0205/dropbox-2.0/models"
+	"github.com/pk0205/dropbox-2.0/repository"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func GetUsers(conn *pgx.Conn) fiber.Handler {
+func GetUsers(repo *repository.Repository) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		rows, err := conn.Query(context.Background(), "SELECT * FROM users")
+		users, err := repo.Users.List(context.Background())
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Database error: " + err.Error()})
 		}
-		defer rows.Close()
-		var users []models.User
-		for rows.Next() {
-			var u models.User
-			err := rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Username, &u.Email, &u.Password)
-			if err != nil {
-				return c.Status(500).JSON(fiber.Map{"error": "Scan error: " + err.Error()})
-			}
-			users = append(users, u)
-		}
 		return c.Status(200).JSON(users)
 	}
 }
 
-func SignUp(conn *pgx.Conn) fiber.Handler {
+func SignUp(repo *repository.Repository) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		user := &models.User{}
 		if err := c.BodyParser(user); err != nil {
@@ -45,9 +36,7 @@ func SignUp(conn *pgx.Conn) fiber.Handler {
 			return c.Status(400).JSON(fiber.Map{"error": "All fields are required"})
 		}
 
-		var exists bool
-		err := conn.QueryRow(context.Background(),
-			"SELECT EXISTS (SELECT 1 FROM users WHERE username=$1)", user.Username).Scan(&exists)
+		exists, err := repo.Users.UsernameExists(context.Background(), user.Username)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Database error: " + err.Error()})
 		}
@@ -55,8 +44,7 @@ func SignUp(conn *pgx.Conn) fiber.Handler {
 			return c.Status(409).JSON(fiber.Map{"error": "Username already taken"})
 		}
 
-		err = conn.QueryRow(context.Background(),
-			"SELECT EXISTS (SELECT 1 FROM users WHERE email=$1)", user.Email).Scan(&exists)
+		exists, err = repo.Users.EmailExists(context.Background(), user.Email)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Database error: " + err.Error()})
 		}
@@ -68,9 +56,7 @@ func SignUp(conn *pgx.Conn) fiber.Handler {
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Error hashing password: " + err.Error()})
 		}
-		_, err = conn.Exec(context.Background(),
-			"INSERT INTO users (id, firstName, lastName, username, email, password) VALUES ($1, $2, $3, $4, $5, $6)",
-			user.ID, user.FirstName, user.LastName, user.Username, user.Email, hashedPassword)
+		err = repo.Users.Create(context.Background(), user, hashedPassword)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Database error: " + err.Error()})
 		}
@@ -104,7 +90,7 @@ func SignUp(conn *pgx.Conn) fiber.Handler {
 }
 }
 
-func Login(conn *pgx.Conn) fiber.Handler {
+func Login(repo *repository.Repository) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		req := struct {
 			EmailOrUsername string `json:"emailOrUsername"`
@@ -119,11 +105,7 @@ func Login(conn *pgx.Conn) fiber.Handler {
 		}
 
 		// Query user by email OR username
-		var user models.User
-		var hashedPassword string
-		err := conn.QueryRow(context.Background(),
-			"SELECT * FROM users WHERE email=$1 OR username=$1",
-			req.EmailOrUsername).Scan(&user.ID, &user.FirstName, &user.LastName, &user.Username, &user.Email, &hashedPassword)
+		user, hashedPassword, err := repo.Users.GetByLogin(context.Background(), req.EmailOrUsername)
 
 		if err != nil {
 			if err == pgx.ErrNoRows {
@@ -164,7 +146,7 @@ func Login(conn *pgx.Conn) fiber.Handler {
 }
 }
 
-func GetMe(conn *pgx.Conn) fiber.Handler {
+func GetMe(repo *repository.Repository) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		// Get username from context (set by RequireAuth middleware)
 		username, ok := c.Locals("userName").(string)
@@ -173,11 +155,7 @@ func GetMe(conn *pgx.Conn) fiber.Handler {
 		}
 
 		// Query user by username
-		var user models.User
-		var hashedPassword string
-		err := conn.QueryRow(context.Background(),
-			"SELECT * FROM users WHERE username=$1", username).Scan(
-			&user.ID, &user.FirstName, &user.LastName, &user.Username, &user.Email, &hashedPassword)
+		user, _, err := repo.Users.GetByUsername(context.Background(), username)
 
 		if err != nil {
 			if err == pgx.ErrNoRows {
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/repository"
+	"github.com/pk0205/dropbox-2.0/storage"
+)
+
+// ListVersions lists the current and previous versions of a file, newest first
+func ListVersions(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fileID := c.Params("fileId")
+		userID := c.Locals("userID").(string)
+
+		file, err := repo.Files.Get(context.Background(), fileID, userID)
+		if err != nil || file.IsFolder {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+		}
+
+		history, err := repo.Versions.List(context.Background(), fileID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get versions"})
+		}
+
+		type VersionInfo struct {
+			VersionNum int       `json:"versionNum"`
+			FileSize   int64     `json:"fileSize"`
+			Checksum   string    `json:"checksum"`
+			CreatedAt  time.Time `json:"createdAt"`
+			IsCurrent  bool      `json:"isCurrent"`
+		}
+
+		versions := []VersionInfo{{
+			VersionNum: file.Version,
+			FileSize:   file.FileSize,
+			Checksum:   file.Checksum,
+			CreatedAt:  file.UpdatedAt,
+			IsCurrent:  true,
+		}}
+		for _, v := range history {
+			versions = append(versions, VersionInfo{
+				VersionNum: v.VersionNum,
+				FileSize:   v.FileSize,
+				Checksum:   v.Checksum,
+				CreatedAt:  v.CreatedAt,
+			})
+		}
+
+		return c.Status(200).JSON(fiber.Map{
+			"fileId":         fileID,
+			"fileName":       file.OriginalName,
+			"currentVersion": file.Version,
+			"versions":       versions,
+		})
+	}
+}
+
+// DownloadVersion streams the content of a specific version of a file
+func DownloadVersion(repo *repository.Repository, store storage.Backend) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fileID := c.Params("fileId")
+		userID := c.Locals("userID").(string)
+
+		versionNum, err := strconv.Atoi(c.Params("version"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid version number"})
+		}
+
+		file, err := repo.Files.Get(context.Background(), fileID, userID)
+		if err != nil || file.IsFolder {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+		}
+
+		d := fileDownload(file)
+		if versionNum != file.Version {
+			v, err := repo.Versions.Get(context.Background(), fileID, versionNum)
+			if err != nil {
+				return c.Status(404).JSON(fiber.Map{"error": "Version not found"})
+			}
+			d.Key, d.Size, d.Checksum, d.ModTime = contentKey(v.BlobID, v.FilePath), v.FileSize, v.Checksum, v.CreatedAt
+		}
+
+		return serveDownload(c, store, d)
+	}
+}
+
+// RestoreVersion makes an old version current again. The restore is itself a
+// new version, so the content being replaced stays in the history.
+func RestoreVersion(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fileID := c.Params("fileId")
+		userID := c.Locals("userID").(string)
+
+		versionNum, err := strconv.Atoi(c.Params("version"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid version number"})
+		}
+
+		var newVersion int
+		err = repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+			file, err := tx.Files.GetForUpdate(context.Background(), fileID, userID)
+			if err != nil {
+				return err
+			}
+			if file.IsFolder {
+				return pgx.ErrNoRows
+			}
+
+			old, err := tx.Versions.Get(context.Background(), fileID, versionNum)
+			if err != nil {
+				return err
+			}
+			if old.BlobID == nil {
+				return errNotAFile // Legacy versions predate the blob store and can't be shared
+			}
+			if err := checkQuota(tx, userID, old.FileSize-file.FileSize, ""); err != nil {
+				return err
+			}
+
+			// The archived row keeps its reference, the files row takes a new one
+			if err := tx.Blobs.AddRef(context.Background(), *old.BlobID, old.FileSize); err != nil {
+				return err
+			}
+			if err := archiveVersion(tx, file); err != nil {
+				return err
+			}
+			if err := revokeSharesOnChange(tx, file, changeModified); err != nil {
+				return err
+			}
+
+			newVersion = file.Version + 1
+			return tx.Files.SetContent(context.Background(), file.ID, *old.BlobID, old.FileSize, "", newVersion)
+		})
+
+		if err == pgx.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Version not found"})
+		}
+		if err == errQuotaExceeded {
+			return quotaExceeded(c)
+		}
+		if err == errNotAFile {
+			return c.Status(409).JSON(fiber.Map{"error": "This version can't be restored"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to restore version"})
+		}
+
+		return c.Status(200).JSON(fiber.Map{
+			"message":      "Version restored successfully",
+			"fileId":       fileID,
+			"restoredFrom": versionNum,
+			"version":      newVersion,
+		})
+	}
+}
+
+// PruneVersions deletes previous versions of a file beyond a count and/or age
+func PruneVersions(repo *repository.Repository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fileID := c.Params("fileId")
+		userID := c.Locals("userID").(string)
+
+		req := struct {
+			Keep       int `json:"keep"`       // Number of previous versions to keep (0 = no limit)
+			MaxAgeDays int `json:"maxAgeDays"` // Delete versions older than this (0 = no limit)
+		}{}
+
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if req.Keep < 0 || req.MaxAgeDays < 0 || (req.Keep == 0 && req.MaxAgeDays == 0) {
+			return c.Status(400).JSON(fiber.Map{"error": "Provide a positive keep and/or maxAgeDays"})
+		}
+
+		if _, err := repo.Files.Get(context.Background(), fileID, userID); err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+		}
+
+		var olderThan *time.Time
+		if req.MaxAgeDays > 0 {
+			cutoff := time.Now().AddDate(0, 0, -req.MaxAgeDays)
+			olderThan = &cutoff
+		}
+
+		pruned, err := pruneVersions(repo, fileID, req.Keep, olderThan)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to prune versions"})
+		}
+
+		return c.Status(200).JSON(fiber.Map{
+			"message": "Versions pruned successfully",
+			"pruned":  pruned,
+		})
+	}
+}
+
+// pruneVersions deletes versions and releases their blob references atomically
+func pruneVersions(repo *repository.Repository, fileID string, keep int, olderThan *time.Time) (int, error) {
+	pruned := 0
+	err := repo.WithTx(context.Background(), func(tx *repository.Repository) error {
+		versions, err := tx.Versions.Prune(context.Background(), fileID, keep, olderThan)
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			// Legacy versions without a blob hold no reference
+			if v.BlobID == "" {
+				continue
+			}
+			if _, err := tx.Blobs.Release(context.Background(), v.BlobID); err != nil {
+				return err
+			}
+		}
+		pruned = len(versions)
+		return nil
+	})
+	return pruned, err
+}
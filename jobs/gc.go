@@ -0,0 +1,227 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pk0205/dropbox-2.0/repository"
+	"github.com/pk0205/dropbox-2.0/storage"
+)
+
+// GCOptions controls a garbage collection pass
+type GCOptions struct {
+	DryRun      bool          // Only report what would be removed
+	GracePeriod time.Duration // Leave anything touched more recently than this alone
+	StorageDir  string        // Local storage root, used to map legacy file_path values to keys
+}
+
+// GCReport lists everything a pass removed (or would remove in dry-run mode)
+type GCReport struct {
+	DryRun             bool     `json:"dryRun"`
+	UnreferencedBlobs  []string `json:"unreferencedBlobs"`
+	AbandonedChunkDirs []string `json:"abandonedChunkDirs"`
+	OrphanedObjects    []string `json:"orphanedObjects"`
+	BytesFreed         int64    `json:"bytesFreed"`
+	Errors             []string `json:"errors,omitempty"`
+}
+
+// CollectGarbage sweeps blobs no file references any more, chunk directories
+// whose upload session is gone or finished, and objects in storage that no
+// database row points at
+func CollectGarbage(ctx context.Context, repo *repository.Repository, store storage.Backend, opts GCOptions) (*GCReport, error) {
+	report := &GCReport{DryRun: opts.DryRun}
+	cutoff := time.Now().Add(-opts.GracePeriod)
+
+	if err := sweepBlobs(ctx, repo, store, opts, cutoff, report); err != nil {
+		return report, err
+	}
+	if err := sweepChunks(ctx, repo, store, opts, cutoff, report); err != nil {
+		return report, err
+	}
+	if err := sweepOrphans(ctx, repo, store, opts, cutoff, report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// sweepBlobs removes blob rows and objects that no file references
+func sweepBlobs(ctx context.Context, repo *repository.Repository, store storage.Backend, opts GCOptions, cutoff time.Time, report *GCReport) error {
+	// Decide on actual references rather than ref_count, which may have
+	// drifted for rows cascaded away before deletes were transactional
+	candidates, err := repo.Blobs.ListUnreferenced(ctx, cutoff)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range candidates {
+		if opts.DryRun {
+			report.UnreferencedBlobs = append(report.UnreferencedBlobs, c.ID)
+			report.BytesFreed += c.Size
+			continue
+		}
+
+		removed, err := deleteBlob(ctx, repo, store, c.ID, cutoff)
+		if err != nil {
+			report.Errors = append(report.Errors, c.ID+": "+err.Error())
+			continue
+		}
+		if removed {
+			report.UnreferencedBlobs = append(report.UnreferencedBlobs, c.ID)
+			report.BytesFreed += c.Size
+		}
+	}
+	return nil
+}
+
+// deleteBlob removes one blob while holding its row lock, so an upload that
+// wants to reuse it either waits and re-uploads or keeps it alive
+func deleteBlob(ctx context.Context, repo *repository.Repository, store storage.Backend, blobID string, cutoff time.Time) (bool, error) {
+	removed := false
+	err := repo.WithTx(ctx, func(tx *repository.Repository) error {
+		locked, err := tx.Blobs.LockUnreferenced(ctx, blobID, cutoff)
+		if err != nil || !locked {
+			return err // Referenced again since the scan
+		}
+
+		if err := store.Delete(ctx, storage.BlobKey(blobID)); err != nil {
+			return err
+		}
+		if err := tx.Blobs.Delete(ctx, blobID); err != nil {
+			return err
+		}
+		removed = true
+		return nil
+	})
+	return removed, err
+}
+
+// sweepChunks removes chunk directories that no active upload session owns
+func sweepChunks(ctx context.Context, repo *repository.Repository, store storage.Backend, opts GCOptions, cutoff time.Time, report *GCReport) error {
+	objects, err := store.List(ctx, "chunks/")
+	if err != nil {
+		return err
+	}
+
+	// Group chunk objects by upload ID, tracking size and newest write
+	type chunkDir struct {
+		size   int64
+		latest time.Time
+	}
+	dirs := map[string]*chunkDir{}
+	for _, obj := range objects {
+		parts := strings.SplitN(strings.TrimPrefix(obj.Key, "chunks/"), "/", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		d, ok := dirs[parts[0]]
+		if !ok {
+			d = &chunkDir{}
+			dirs[parts[0]] = d
+		}
+		d.size += obj.Size
+		if obj.ModTime.After(d.latest) {
+			d.latest = obj.ModTime
+		}
+	}
+
+	for uploadID, d := range dirs {
+		if d.latest.After(cutoff) {
+			continue
+		}
+
+		active, err := repo.Uploads.IsActive(ctx, uploadID)
+		if err != nil {
+			return err
+		}
+		if active {
+			continue
+		}
+
+		prefix := path.Join("chunks", uploadID) + "/"
+		if !opts.DryRun {
+			if err := storage.DeletePrefix(ctx, store, prefix); err != nil {
+				report.Errors = append(report.Errors, prefix+": "+err.Error())
+				continue
+			}
+		}
+		report.AbandonedChunkDirs = append(report.AbandonedChunkDirs, prefix)
+		report.BytesFreed += d.size
+	}
+	return nil
+}
+
+// sweepOrphans removes blob objects without a blobs row and legacy per-user
+// files that no files.file_path points at
+func sweepOrphans(ctx context.Context, repo *repository.Repository, store storage.Backend, opts GCOptions, cutoff time.Time, report *GCReport) error {
+	known := map[string]bool{}
+
+	blobIDs, err := repo.Blobs.ListIDs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range blobIDs {
+		known[storage.BlobKey(id)] = true
+	}
+
+	filePaths, err := repo.Files.LegacyPaths(ctx)
+	if err != nil {
+		return err
+	}
+	for _, filePath := range filePaths {
+		known[storage.PathKey(filePath, opts.StorageDir)] = true
+	}
+
+	for _, prefix := range []string{"blobs/", "users/"} {
+		objects, err := store.List(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			// Recent objects may belong to an upload that hasn't written its row yet
+			if known[obj.Key] || obj.ModTime.After(cutoff) {
+				continue
+			}
+			if !opts.DryRun {
+				if err := store.Delete(ctx, obj.Key); err != nil {
+					report.Errors = append(report.Errors, obj.Key+": "+err.Error())
+					continue
+				}
+			}
+			report.OrphanedObjects = append(report.OrphanedObjects, obj.Key)
+			report.BytesFreed += obj.Size
+		}
+	}
+	return nil
+}
+
+// RunGC runs CollectGarbage every interval until ctx is cancelled, logging each report
+func RunGC(ctx context.Context, repo *repository.Repository, store storage.Backend, interval time.Duration, opts GCOptions) {
+	every(ctx, interval, func() {
+		report, err := CollectGarbage(ctx, repo, store, opts)
+		if err != nil {
+			log.Println("gc: pass failed:", err)
+			return
+		}
+		log.Printf("gc: dryRun=%v blobs=%d chunkDirs=%d orphans=%d bytes=%d errors=%d",
+			report.DryRun, len(report.UnreferencedBlobs), len(report.AbandonedChunkDirs),
+			len(report.OrphanedObjects), report.BytesFreed, len(report.Errors))
+	})
+}
+
+// every calls fn every interval until ctx is cancelled
+func every(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
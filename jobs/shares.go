@@ -0,0 +1,23 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pk0205/dropbox-2.0/repository"
+)
+
+// RunUnlockAttemptPurge removes share password attempt counters that have
+// outlived window and aren't locked, every interval until ctx is cancelled,
+// so addresses that tried once don't pile up
+func RunUnlockAttemptPurge(ctx context.Context, repo *repository.Repository, interval, window time.Duration) {
+	every(ctx, interval, func() {
+		purged, err := repo.Shares.PurgeUnlockAttempts(ctx, time.Now().Add(-window))
+		if err != nil {
+			log.Println("shares: unlock attempt purge failed:", err)
+			return
+		}
+		log.Printf("shares: unlock attempt counters purged=%d", purged)
+	})
+}
@@ -0,0 +1,49 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/repository"
+)
+
+// PurgeTrash permanently deletes items that have been in the trash for
+// longer than retention and releases their blob references. It returns the
+// number of trashed items removed.
+func PurgeTrash(ctx context.Context, repo *repository.Repository, retention time.Duration) (int, error) {
+	cutoff := time.Now().Add(-retention)
+	expired, err := repo.Files.ListExpiredTrash(ctx, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, item := range expired {
+		// Re-checked under the row lock in case it was restored and trashed again
+		err := repo.WithTx(ctx, func(tx *repository.Repository) error {
+			return tx.PurgeTrashed(ctx, item.ID, item.UserID, &cutoff)
+		})
+		if err == pgx.ErrNoRows {
+			continue // Restored or purged since it was listed
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// RunTrashPurge runs PurgeTrash every interval until ctx is cancelled
+func RunTrashPurge(ctx context.Context, repo *repository.Repository, interval, retention time.Duration) {
+	every(ctx, interval, func() {
+		purged, err := PurgeTrash(ctx, repo, retention)
+		if err != nil {
+			log.Println("trash: purge failed:", err)
+			return
+		}
+		log.Printf("trash: purged=%d", purged)
+	})
+}
@@ -0,0 +1,78 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"path"
+	"time"
+
+	"github.com/pk0205/dropbox-2.0/repository"
+	"github.com/pk0205/dropbox-2.0/storage"
+)
+
+// ReapReport counts what one reaper pass cleaned up
+type ReapReport struct {
+	Expired   int // Sessions past expires_at that were still accepting data
+	Stuck     int // Sessions that had been assembling for longer than the timeout
+	TempFiles int // Partial assembly and upload files left behind
+	ChunkDirs int // Chunk directories removed
+	Errors    []string
+}
+
+// ReapUploads expires upload sessions past their expiry and fails sessions
+// that have been assembling for longer than assemblyTimeout, removing their
+// chunks and any partial output. Both leave the states that reserve quota,
+// so the reservation is released with the status change.
+func ReapUploads(ctx context.Context, repo *repository.Repository, store storage.Backend, assemblyTimeout time.Duration) (*ReapReport, error) {
+	report := &ReapReport{}
+	cutoff := time.Now().Add(-assemblyTimeout)
+
+	expired, err := repo.Uploads.ExpireStale(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.Expired = len(expired)
+
+	stuck, err := repo.Uploads.FailStuck(ctx, cutoff, "assembly timed out")
+	if err != nil {
+		return report, err
+	}
+	report.Stuck = len(stuck)
+
+	for _, uploadID := range append(expired, stuck...) {
+		prefix := path.Join("chunks", uploadID) + "/"
+		if err := storage.DeletePrefix(ctx, store, prefix); err != nil {
+			report.Errors = append(report.Errors, prefix+": "+err.Error())
+			continue
+		}
+		report.ChunkDirs++
+	}
+
+	// Temp files still being written keep a recent modification time, so
+	// anything untouched for the timeout was left by a dead assembly or
+	// parallel upload
+	for _, pattern := range []string{"assemble-*", "upload-*"} {
+		n, err := storage.RemoveTemp(store, pattern, cutoff)
+		report.TempFiles += n
+		if err != nil {
+			report.Errors = append(report.Errors, pattern+": "+err.Error())
+		}
+	}
+	return report, nil
+}
+
+// RunUploadReaper runs ReapUploads every interval until ctx is cancelled
+func RunUploadReaper(ctx context.Context, repo *repository.Repository, store storage.Backend, interval, assemblyTimeout time.Duration) {
+	every(ctx, interval, func() {
+		report, err := ReapUploads(ctx, repo, store, assemblyTimeout)
+		if err != nil {
+			log.Println("uploads: reap failed:", err)
+			return
+		}
+		for _, e := range report.Errors {
+			log.Println("uploads: reap error:", e)
+		}
+		log.Printf("uploads: expired=%d stuck=%d chunkDirs=%d tempFiles=%d",
+			report.Expired, report.Stuck, report.ChunkDirs, report.TempFiles)
+	})
+}
@@ -0,0 +1,62 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pk0205/dropbox-2.0/repository"
+)
+
+// RetentionPolicy bounds how much version history is kept for every file
+type RetentionPolicy struct {
+	Keep   int           // Previous versions kept per file (0 = no limit)
+	MaxAge time.Duration // Previous versions older than this are deleted (0 = no limit)
+}
+
+// Enabled reports whether the policy removes anything at all
+func (p RetentionPolicy) Enabled() bool {
+	return p.Keep > 0 || p.MaxAge > 0
+}
+
+// PruneVersions applies the retention policy to all files and releases the
+// blob references held by the deleted versions. The blobs themselves are
+// removed by the garbage collector.
+func PruneVersions(ctx context.Context, repo *repository.Repository, policy RetentionPolicy) (int, error) {
+	var olderThan *time.Time
+	if policy.MaxAge > 0 {
+		cutoff := time.Now().Add(-policy.MaxAge)
+		olderThan = &cutoff
+	}
+
+	pruned := 0
+	err := repo.WithTx(ctx, func(tx *repository.Repository) error {
+		versions, err := tx.Versions.Prune(ctx, "", policy.Keep, olderThan)
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			if v.BlobID == "" {
+				continue
+			}
+			if _, err := tx.Blobs.Release(ctx, v.BlobID); err != nil {
+				return err
+			}
+		}
+		pruned = len(versions)
+		return nil
+	})
+	return pruned, err
+}
+
+// RunVersionPruning runs PruneVersions every interval until ctx is cancelled
+func RunVersionPruning(ctx context.Context, repo *repository.Repository, interval time.Duration, policy RetentionPolicy) {
+	every(ctx, interval, func() {
+		pruned, err := PruneVersions(ctx, repo, policy)
+		if err != nil {
+			log.Println("versions: prune failed:", err)
+			return
+		}
+		log.Printf("versions: pruned=%d", pruned)
+	})
+}
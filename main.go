@@ -2,28 +2,48 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
 	"github.com/pk0205/dropbox-2.0/db"
 	"github.com/pk0205/dropbox-2.0/handlers"
+	"github.com/pk0205/dropbox-2.0/jobs"
 	"github.com/pk0205/dropbox-2.0/middleware"
+	"github.com/pk0205/dropbox-2.0/repository"
+	"github.com/pk0205/dropbox-2.0/storage"
 )
 
 func main() {
+	bodyLimit := 100 * 1024 * 1024 // 100MB max body size
 	app := fiber.New(fiber.Config{
-		BodyLimit: 100 * 1024 * 1024, // 100MB max body size
+		BodyLimit: bodyLimit,
+		// Bodies over BodyLimit are streamed to the handler instead of
+		// rejected; parallel uploads read them part by part
+		StreamRequestBody: true,
 	})
 
 	// Middleware
 	app.Use(logger.New())
+	app.Use(middleware.BodyLimit(bodyLimit, "/api/files/parallel-upload"))
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: "http://localhost:5173",
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization",
+		AllowHeaders: "Origin, Content-Type, Accept, Authorization, " +
+			"Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, Upload-Checksum, " +
+			"Range, If-Range, If-Match, If-None-Match, If-Modified-Since, If-Unmodified-Since, " +
+			handlers.ShareAccessHeader,
+		ExposeHeaders: "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Checksum-Algorithm, " +
+			"Upload-Offset, Upload-Length, Upload-Metadata, Upload-Expires, X-File-Id, " +
+			"Accept-Ranges, Content-Range, Content-Disposition, ETag, Last-Modified",
 		AllowCredentials: true,
 	}))
 
@@ -38,15 +58,90 @@ func main() {
     if err != nil {
         log.Fatal("Error connecting DB:", err)
     }
-    defer conn.Close(context.Background())
+    defer conn.Close()
 
     if err := db.PingDB(conn); err != nil {
         log.Fatal("Unable to ping database:", err)
     }
 
-    if err := db.SetupDB(conn); err != nil {
-        log.Fatal("Unable to setup database:", err)
-    }
+	// `migrate up|down [n]|status` manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(conn, os.Args[2:])
+		return
+	}
+
+	// Bring the schema up to date on every start; the advisory lock makes
+	// this safe when several instances boot together
+	applied, err := db.MigrateUp(context.Background(), conn)
+	if err != nil {
+		log.Fatal("Unable to migrate database:", err)
+	}
+	for _, m := range applied {
+		log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+	}
+
+	// Blob storage (local disk or S3, see STORAGE_BACKEND)
+	store, err := storage.FromEnv(handlers.StorageDir, "storage/")
+	if err != nil {
+		log.Fatal("Unable to setup storage:", err)
+	}
+	uploads, err := storage.FromEnv(handlers.UploadDir, "uploads/")
+	if err != nil {
+		log.Fatal("Unable to setup storage:", err)
+	}
+
+	repo := repository.New(conn)
+
+	gcOpts := jobs.GCOptions{
+		DryRun:      os.Getenv("GC_DRY_RUN") == "true",
+		GracePeriod: envDuration("GC_GRACE_PERIOD", time.Hour),
+		StorageDir:  handlers.StorageDir,
+	}
+
+	// `gc [-dry-run]` runs a single garbage collection pass, prints the report and exits
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		gcFlags := flag.NewFlagSet("gc", flag.ExitOnError)
+		dryRun := gcFlags.Bool("dry-run", false, "report what would be removed without deleting anything")
+		gcFlags.Parse(os.Args[2:])
+		gcOpts.DryRun = gcOpts.DryRun || *dryRun
+
+		report, err := jobs.CollectGarbage(context.Background(), repo, store, gcOpts)
+		if err != nil {
+			log.Fatal("Garbage collection failed:", err)
+		}
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	// Background garbage collection
+	go jobs.RunGC(context.Background(), repo, store, envDuration("GC_INTERVAL", time.Hour), gcOpts)
+
+	// Background reaper for expired and stuck upload sessions
+	go jobs.RunUploadReaper(context.Background(), repo, store, envDuration("UPLOAD_REAP_INTERVAL", 15*time.Minute), envDuration("UPLOAD_ASSEMBLY_TIMEOUT", time.Hour))
+
+	// Background purge of items that have been in the trash too long
+	go jobs.RunTrashPurge(context.Background(), repo, envDuration("TRASH_PURGE_INTERVAL", time.Hour), envDuration("TRASH_RETENTION", 30*24*time.Hour))
+
+	// Parallel uploads skip the body limit and cap their files themselves
+	parallelUploadMax := int64(envInt("PARALLEL_UPLOAD_MAX_BYTES", handlers.DefaultParallelUploadMax))
+
+	// Share password attempts are throttled per link and per address
+	unlockPolicy := handlers.UnlockPolicy{
+		TokenAttempts: envInt("SHARE_UNLOCK_ATTEMPTS", 5),
+		IPAttempts:    envInt("SHARE_UNLOCK_IP_ATTEMPTS", 20),
+		Window:        envDuration("SHARE_UNLOCK_WINDOW", 15*time.Minute),
+		Lockout:       envDuration("SHARE_UNLOCK_LOCKOUT", 15*time.Minute),
+		AccessTTL:     envDuration("SHARE_ACCESS_TTL", time.Hour),
+	}
+	go jobs.RunUnlockAttemptPurge(context.Background(), repo, time.Hour, unlockPolicy.Window)
+
+	// Background version pruning, only when a retention policy is configured
+	keepVersions, _ := strconv.Atoi(os.Getenv("VERSION_KEEP"))
+	retention := jobs.RetentionPolicy{Keep: keepVersions, MaxAge: envDuration("VERSION_MAX_AGE", 0)}
+	if retention.Enabled() {
+		go jobs.RunVersionPruning(context.Background(), repo, envDuration("VERSION_PRUNE_INTERVAL", time.Hour), retention)
+	}
 
 
 	app.Get("/", func(c *fiber.Ctx) error {
@@ -54,48 +149,180 @@ func main() {
 	})
 
 	// Public routes
-	app.Post("/api/user/signup", handlers.SignUp(conn))
-	app.Post("/api/user/login", handlers.Login(conn))
+	app.Post("/api/user/signup", handlers.SignUp(repo))
+	app.Post("/api/user/login", handlers.Login(repo))
 	app.Post("/api/user/logout", handlers.Logout())
 
 	// Public share routes (no authentication required)
-	app.Get("/share/:token", handlers.GetSharedFile(conn))
-	app.Get("/api/share/:token/info", handlers.GetShareInfo(conn))
+	app.Post("/share/:token/unlock", handlers.UnlockShare(repo, unlockPolicy))
+	app.Get("/share/:token", handlers.GetSharedFile(repo, store))
+	app.Get("/share/:token/archive", handlers.DownloadSharedArchive(repo, store))
+	app.Get("/share/:token/browse", handlers.BrowseSharedFolder(repo))
+	app.Get("/share/:token/files/:fileId", handlers.GetSharedItem(repo, store))
+	app.Get("/api/share/:token/info", handlers.GetShareInfo(repo))
+
+	// File request links accept chunked uploads from anyone with the link
+	app.Post("/share/:token/upload/init", handlers.FileRequestUploadInit(repo))
+	app.Get("/share/:token/upload/:uploadId", handlers.FileRequestUploadStatus(repo))
+	app.Post("/share/:token/upload/:uploadId", handlers.FileRequestUploadChunk(repo, store))
+	app.Post("/share/:token/upload/:uploadId/complete", handlers.FileRequestUploadComplete(repo, store))
+
+	// Presigned download URLs carry their own signature instead of a session
+	app.Get("/presigned/:fileId", handlers.PresignedDownload(repo, store))
+
+	// tus discovery is unauthenticated so clients can probe the server
+	app.Options("/api/tus", handlers.TusResumable(), handlers.TusOptions())
 
 	// Protected routes - require authentication
 	api := app.Group("/api", middleware.RequireAuth)
 
 	// User routes
-	api.Get("/users", handlers.GetUsers(conn))
-	api.Get("/me", handlers.GetMe(conn))
+	api.Get("/users", handlers.GetUsers(repo))
+	api.Get("/me", handlers.GetMe(repo))
+	api.Get("/me/usage", handlers.GetUsage(repo))
 
 	// File management routes
-	api.Get("/files", handlers.ListFiles(conn))
-	api.Delete("/files/:fileId", handlers.DeleteFile(conn))
+	api.Get("/files", handlers.ListFiles(repo))
+	api.Delete("/files/:fileId", handlers.DeleteFile(repo))
+	api.Patch("/files/:fileId", handlers.UpdateFile(repo))
+	api.Post("/files/:fileId/copy", handlers.CopyFile(repo))
 	
 	// Basic upload/download (for small files)
-	api.Post("/files/upload", handlers.UploadFile())
-	api.Get("/files/download/:fileName", handlers.DownloadFile())
+	api.Post("/files/upload", handlers.UploadFile(uploads))
+	api.Get("/files/download/:fileName", handlers.DownloadFile(uploads))
 
 	// Advanced file operations
-	api.Post("/files/parallel-upload", handlers.ParallelUpload(conn))
-	api.Get("/files/stream-download/:fileId", handlers.StreamDownload(conn))
+	api.Post("/files/parallel-upload", handlers.ParallelUpload(repo, store, parallelUploadMax))
+	api.Get("/files/stream-download/:fileId", handlers.StreamDownload(repo, store))
+	api.Post("/files/:fileId/presign", handlers.PresignDownload(repo))
+
+	// Folder and multi-select downloads as ZIP or tar.gz archives
+	api.Post("/files/archive", handlers.DownloadSelectionArchive(repo, store))
+	api.Get("/files/:folderId/archive", handlers.DownloadFolderArchive(repo, store))
 
 	// Chunked upload for large files
-	api.Post("/files/chunk-upload/init", handlers.ChunkedUploadInit(conn))
-	api.Post("/files/chunk-upload/:uploadId", handlers.ChunkedUploadChunk(conn))
-	api.Post("/files/chunk-upload/:uploadId/complete", handlers.ChunkedUploadComplete(conn))
+	api.Post("/files/chunk-upload/init", handlers.ChunkedUploadInit(repo))
+	api.Get("/files/chunk-upload/:uploadId", handlers.ChunkedUploadStatus(repo))
+	api.Post("/files/chunk-upload/:uploadId", handlers.ChunkedUploadChunk(repo, store))
+	api.Post("/files/chunk-upload/:uploadId/extend", handlers.ChunkedUploadExtend(repo))
+	api.Post("/files/chunk-upload/:uploadId/complete", handlers.ChunkedUploadComplete(repo, store))
+
+	// tus 1.0 resumable uploads (creation, expiration, checksum, termination)
+	tus := api.Group("/tus", handlers.TusResumable())
+	tus.Post("/", handlers.TusCreate(repo, store))
+	tus.Head("/:uploadId", handlers.TusHead(repo))
+	tus.Patch("/:uploadId", handlers.TusPatch(repo, store))
+	tus.Delete("/:uploadId", handlers.TusDelete(repo, store))
+
+	// File version history
+	api.Get("/files/:fileId/versions", handlers.ListVersions(repo))
+	api.Get("/files/:fileId/versions/:version/download", handlers.DownloadVersion(repo, store))
+	api.Post("/files/:fileId/versions/prune", handlers.PruneVersions(repo))
+	api.Post("/files/:fileId/versions/:version/restore", handlers.RestoreVersion(repo))
+
+	// Trash
+	api.Get("/trash", handlers.ListTrash(repo))
+	api.Delete("/trash", handlers.EmptyTrash(repo))
+	api.Post("/trash/:fileId/restore", handlers.RestoreFile(repo))
+	api.Delete("/trash/:fileId", handlers.DeleteFromTrash(repo))
 
 	// Folder operations
-	api.Post("/folders", handlers.CreateFolder(conn))
+	api.Post("/folders", handlers.CreateFolder(repo))
+
+	// Sharing with users and groups
+	api.Get("/shared-with-me", handlers.ListSharedWithMe(repo))
+	api.Get("/files/:fileId/permissions", handlers.ListPermissions(repo))
+	api.Post("/files/:fileId/permissions", handlers.GrantPermission(repo))
+	api.Delete("/files/:fileId/permissions/:permissionId", handlers.RevokePermission(repo))
+	api.Get("/groups", handlers.ListGroups(repo))
+	api.Post("/groups", handlers.CreateGroup(repo))
+	api.Post("/groups/:groupId/members", handlers.AddGroupMember(repo))
+	api.Delete("/groups/:groupId/members/:username", handlers.RemoveGroupMember(repo))
 
 	// Share management (authenticated)
-	api.Post("/shares", handlers.CreateShareLink(conn))
-	api.Get("/shares", handlers.ListUserShares(conn))
-	api.Delete("/shares/:shareId", handlers.DeleteShareLink(conn))
-	api.Put("/shares/:shareId", handlers.UpdateShareLink(conn))
+	api.Post("/shares", handlers.CreateShareLink(repo))
+	api.Get("/shares", handlers.ListUserShares(repo))
+	api.Delete("/shares/:shareId", handlers.DeleteShareLink(repo))
+	api.Put("/shares/:shareId", handlers.UpdateShareLink(repo))
+	api.Get("/shares/:shareId/uploads", handlers.ListFileRequestUploads(repo))
+	api.Get("/shares/:shareId/activity", handlers.GetShareActivity(repo))
+
+	// Notifications, e.g. revoked share links
+	api.Get("/notifications", handlers.ListNotifications(repo))
+	api.Post("/notifications/read", handlers.MarkAllNotificationsRead(repo))
+	api.Post("/notifications/:notificationId/read", handlers.MarkNotificationRead(repo))
 
 
 	log.Fatal(app.Listen(":" + PORT))
 
-}
\ No newline at end of file
+}
+
+// envDuration reads a duration such as "30m" or "24h" from the environment
+func envDuration(key string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || d <= 0 {
+		return fallback
+	}
+	return d
+}
+
+// envInt reads a positive integer from the environment
+func envInt(key string, fallback int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || n <= 0 {
+		return fallback
+	}
+	return n
+}
+
+// runMigrate implements the migrate subcommand
+func runMigrate(pool *pgxpool.Pool, args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: migrate up|down [steps]|status")
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp(ctx, pool)
+		if err != nil {
+			log.Fatal("Migration failed:", err)
+		}
+		for _, m := range applied {
+			fmt.Printf("applied  %04d_%s\n", m.Version, m.Name)
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				log.Fatal("migrate down: steps must be a positive number")
+			}
+			steps = n
+		}
+		reverted, err := db.MigrateDown(ctx, pool, steps)
+		if err != nil {
+			log.Fatal("Migration failed:", err)
+		}
+		for _, m := range reverted {
+			fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		}
+	case "status":
+		statuses, err := db.Status(ctx, pool)
+		if err != nil {
+			log.Fatal("Unable to read migration status:", err)
+		}
+		for _, st := range statuses {
+			applied := "pending"
+			if st.AppliedAt != nil {
+				applied = st.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-30s %s\n", st.Version, st.Name, applied)
+		}
+	default:
+		log.Fatal("usage: migrate up|down [steps]|status")
+	}
+}
@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// BodyLimit rejects requests with a body larger than limit bytes. With
+// StreamRequestBody enabled Fiber hands oversized bodies to the handler
+// instead of rejecting them, so this restores the limit for every path except
+// those in streamed, whose handlers read the body incrementally and enforce
+// their own limits.
+func BodyLimit(limit int, streamed ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		for _, p := range streamed {
+			if c.Path() == p {
+				return c.Next()
+			}
+		}
+
+		length := c.Request().Header.ContentLength()
+		if length > limit {
+			return bodyTooLarge(c)
+		}
+
+		// A chunked body declares no length, so it is read here, never more
+		// than one byte past the limit, and handed on already buffered
+		if stream := c.Context().RequestBodyStream(); length < 0 && stream != nil {
+			body, err := io.ReadAll(io.LimitReader(stream, int64(limit)+1))
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Failed to read request body"})
+			}
+			if len(body) > limit {
+				return bodyTooLarge(c)
+			}
+			c.Request().SetBody(body)
+		}
+		return c.Next()
+	}
+}
+
+// bodyTooLarge refuses the request, closing the connection as the rest of
+// the body is left unread
+func bodyTooLarge(c *fiber.Ctx) error {
+	c.Context().SetConnectionClose()
+	return c.Status(413).JSON(fiber.Map{"error": "Request body too large"})
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestBodyLimit(t *testing.T) {
+	const limit = 64
+	app := fiber.New(fiber.Config{BodyLimit: limit, StreamRequestBody: true})
+	app.Use(BodyLimit(limit, "/streamed"))
+	echo := func(c *fiber.Ctx) error {
+		return c.Send(c.Body())
+	}
+	app.Post("/", echo)
+	app.Post("/streamed", func(c *fiber.Ctx) error {
+		n, err := io.Copy(io.Discard, c.Context().RequestBodyStream())
+		if err != nil {
+			return err
+		}
+		return c.SendString(strings.Repeat("x", int(n)))
+	})
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendString("ok")
+	})
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		size    int
+		chunked bool
+		status  int
+	}{
+		{"small", "POST", "/", 10, false, 200},
+		{"at limit", "POST", "/", limit, false, 200},
+		{"over limit", "POST", "/", limit + 1, false, 413},
+		{"chunked small", "POST", "/", 10, true, 200},
+		{"chunked at limit", "POST", "/", limit, true, 200},
+		{"chunked over limit", "POST", "/", limit * 4, true, 413},
+		{"streamed over limit", "POST", "/streamed", limit * 4, false, 200},
+		{"streamed chunked", "POST", "/streamed", limit * 4, true, 200},
+		{"no body", "GET", "/", 0, false, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.Repeat("a", tt.size)
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+			if tt.chunked {
+				req.ContentLength = -1
+				req.TransferEncoding = []string{"chunked"}
+			}
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d; want %d (%s)", resp.StatusCode, tt.status, got)
+			}
+			if tt.status == 200 && tt.method == "POST" && len(got) != tt.size {
+				t.Errorf("handler saw %d bytes; want %d", len(got), tt.size)
+			}
+		})
+	}
+}
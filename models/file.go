@@ -3,42 +3,141 @@ package models
 import "time"
 
 type File struct {
-	ID          string    `json:"id"`
-	UserID      string    `json:"userId"`
-	FileName    string    `json:"fileName"`
-	OriginalName string   `json:"originalName"`
-	FilePath    string    `json:"filePath"`
-	FileSize    int64     `json:"fileSize"`
-	MimeType    string    `json:"mimeType"`
-	Checksum    string    `json:"checksum"` // SHA-256 hash for deduplication
-	ParentID    *string   `json:"parentId"` // For folder structure
-	IsFolder    bool      `json:"isFolder"`
-	IsShared    bool      `json:"isShared"`
-	CreatedAt   time.Time `json:"createdAt"`
-	UpdatedAt   time.Time `json:"updatedAt"`
+	ID           string     `json:"id"`
+	UserID       string     `json:"userId"`
+	FileName     string     `json:"fileName"`
+	OriginalName string     `json:"originalName"`
+	FilePath     string     `json:"filePath"` // Legacy per-user path, new files use BlobID
+	BlobID       *string    `json:"blobId"`   // SHA-256 of the content in the blob store
+	FileSize     int64      `json:"fileSize"`
+	MimeType     string     `json:"mimeType"`
+	Checksum     string     `json:"checksum"` // SHA-256 hash for deduplication
+	ParentID     *string    `json:"parentId"` // For folder structure
+	IsFolder     bool       `json:"isFolder"`
+	IsShared     bool       `json:"isShared"`
+	Version      int        `json:"version"`             // Current version number, older ones live in file_versions
+	DeletedAt    *time.Time `json:"deletedAt,omitempty"` // Set while the item is in the trash
+	CreatedAt    time.Time  `json:"createdAt"`
+	UpdatedAt    time.Time  `json:"updatedAt"`
 }
 
 type ChunkUpload struct {
-	ID           string    `json:"id"`
-	UserID       string    `json:"userId"`
-	FileName     string    `json:"fileName"`
-	TotalChunks  int       `json:"totalChunks"`
-	ChunkSize    int64     `json:"chunkSize"`
-	TotalSize    int64     `json:"totalSize"`
-	UploadedChunks []int   `json:"uploadedChunks"`
-	Status       string    `json:"status"` // pending, uploading, completed, failed
-	CreatedAt    time.Time `json:"createdAt"`
-	ExpiresAt    time.Time `json:"expiresAt"`
+	ID               string    `json:"id"`
+	UserID           string    `json:"userId"`
+	OwnerID          string    `json:"ownerId"` // Owner of the destination folder, whose quota the upload reserves
+	FileName         string    `json:"fileName"`
+	TotalChunks      int       `json:"totalChunks"`
+	ChunkSize        int64     `json:"chunkSize"`
+	TotalSize        int64     `json:"totalSize"`
+	UploadedChunks   []int     `json:"uploadedChunks"`
+	FileID           *string   `json:"fileId"`                 // Existing file the upload becomes a new version of, then the resulting file
+	Status           string    `json:"status"`                 // pending, uploading, assembling, completed, failed, expired
+	Error            string    `json:"error,omitempty"`        // Why assembly failed
+	Protocol         string    `json:"protocol"`               // chunked or tus
+	Offset           int64     `json:"offset"`                 // Bytes received so far (tus)
+	Metadata         string    `json:"metadata"`               // Raw Upload-Metadata header (tus)
+	ExpectedChecksum string    `json:"expectedChecksum"`       // SHA-256 the assembled file must match, optional
+	ParentID         *string   `json:"parentId"`               // Folder the file goes into (nil for root)
+	OnConflict       string    `json:"onConflict"`             // rename, version or reject when the name is taken
+	ShareID          *string   `json:"shareId,omitempty"`      // File request link the upload came through
+	UploaderName     string    `json:"uploaderName,omitempty"` // As given by an anonymous uploader
+	UploaderEmail    string    `json:"uploaderEmail,omitempty"`
+	CreatedAt        time.Time `json:"createdAt"`
+	ExpiresAt        time.Time `json:"expiresAt"`
+}
+
+// ChunkPart is one received chunk of a chunked upload
+type ChunkPart struct {
+	UploadID    string    `json:"uploadId"`
+	ChunkNumber int       `json:"chunkNumber"`
+	Size        int64     `json:"size"`
+	Checksum    string    `json:"checksum"` // SHA-256 computed by the server
+	CreatedAt   time.Time `json:"createdAt"`
 }
 
+// Share link kinds
+const (
+	ShareKindRead   = "read"   // Anyone with the link can view and download
+	ShareKindUpload = "upload" // File request: anyone with the link can upload into the folder
+)
+
 type ShareLink struct {
-	ID        string    `json:"id"`
-	FileID    string    `json:"fileId"`
-	UserID    string    `json:"userId"`
-	Token     string    `json:"token"`
-	ExpiresAt *time.Time `json:"expiresAt"`
-	Password  *string   `json:"password"`
-	CreatedAt time.Time `json:"createdAt"`
+	ID                  string     `json:"id"`
+	FileID              string     `json:"fileId"`
+	UserID              string     `json:"userId"`
+	Token               string     `json:"token"`
+	ExpiresAt           *time.Time `json:"expiresAt"`
+	Password            *string    `json:"password"`
+	CreatedAt           time.Time  `json:"createdAt"`
+	Kind                string     `json:"kind"`
+	MaxFileSize         *int64     `json:"maxFileSize,omitempty"`       // Largest file a file request accepts
+	AllowedExtensions   []string   `json:"allowedExtensions,omitempty"` // e.g. ".pdf"; empty allows any
+	RequireUploaderInfo bool       `json:"requireUploaderInfo"`         // File request uploaders must give a name and email
+	MaxDownloads        *int       `json:"maxDownloads,omitempty"`      // Downloads allowed before the link stops working, 1 for one-time links
+	DownloadCount       int        `json:"downloadCount"`
+	OnChange            string     `json:"onChange"`                 // follow, pin or revoke
+	PinnedVersion       *int       `json:"pinnedVersion,omitempty"`  // Version a pinned link serves
+	PinnedChecksum      *string    `json:"pinnedChecksum,omitempty"` // SHA-256 of the pinned version
+	RevokedAt           *time.Time `json:"revokedAt,omitempty"`      // Set once a revoke-on-change link has stopped working
+	RevokedReason       string     `json:"revokedReason,omitempty"`
+}
+
+// What a read link does when the item it points at changes
+const (
+	ShareOnChangeFollow = "follow" // Serve the current content
+	ShareOnChangePin    = "pin"    // Keep serving the version the link was created at
+	ShareOnChangeRevoke = "revoke" // Stop working and notify the link's owner
+)
+
+// Share access log actions
+const (
+	ShareActionAccess   = "access"   // Refused before the request got anywhere
+	ShareActionView     = "view"     // Folder listing
+	ShareActionDownload = "download" // File content
+	ShareActionArchive  = "archive"  // Folder as ZIP or tar.gz
+	ShareActionUpload   = "upload"   // File received through a file request
+	ShareActionUnlock   = "unlock"   // Right password given
+)
+
+// Share access log outcomes
+const (
+	ShareOutcomeSuccess = "success"
+	ShareOutcomeDenied  = "denied"
+)
+
+// ShareAccess is one use of a share link
+type ShareAccess struct {
+	ID          string    `json:"id"`
+	ShareID     string    `json:"shareId"`
+	FileID      *string   `json:"fileId"` // Item inside the share that was accessed
+	Action      string    `json:"action"`
+	Outcome     string    `json:"outcome"`
+	Reason      string    `json:"reason,omitempty"` // Why access was denied
+	IP          string    `json:"ip"`
+	UserAgent   string    `json:"userAgent"`
+	BytesServed int64     `json:"bytesServed"` // Bytes sent, or received for uploads
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// ShareStats sums up the access log of a share link
+type ShareStats struct {
+	Views          int        `json:"views"`
+	Downloads      int        `json:"downloads"` // Successful file and archive downloads
+	Uploads        int        `json:"uploads"`
+	Denied         int        `json:"denied"`
+	BytesServed    int64      `json:"bytesServed"` // Sent by views and downloads
+	LastAccessedAt *time.Time `json:"lastAccessedAt"`
+}
+
+// FileRequestUpload is a file received through a file request link
+type FileRequestUpload struct {
+	UploadID      string    `json:"uploadId"`
+	FileID        string    `json:"fileId"`
+	FileName      string    `json:"fileName"`
+	FileSize      int64     `json:"fileSize"`
+	UploaderName  string    `json:"uploaderName"`
+	UploaderEmail string    `json:"uploaderEmail"`
+	UploadedAt    time.Time `json:"uploadedAt"`
 }
 
 type FileVersion struct {
@@ -46,8 +145,8 @@ type FileVersion struct {
 	FileID     string    `json:"fileId"`
 	VersionNum int       `json:"versionNum"`
 	FilePath   string    `json:"filePath"`
+	BlobID     *string   `json:"blobId"`
 	FileSize   int64     `json:"fileSize"`
 	Checksum   string    `json:"checksum"`
 	CreatedAt  time.Time `json:"createdAt"`
 }
-
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// Notification kinds
+const (
+	NotificationShareRevoked = "share_revoked" // A revoke-on-change share link stopped working
+)
+
+// Notification tells a user about something that happened to their items
+type Notification struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"userId"`
+	Kind      string     `json:"kind"`
+	Message   string     `json:"message"`
+	ShareID   *string    `json:"shareId,omitempty"`
+	FileID    *string    `json:"fileId,omitempty"`
+	ReadAt    *time.Time `json:"readAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// Roles a permission can grant, from least to most access
+const (
+	RoleViewer    = "viewer"    // List and download
+	RoleCommenter = "commenter" // Viewer, plus commenting once comments exist
+	RoleEditor    = "editor"    // Upload, create folders and delete
+	RoleOwner     = "owner"     // Editor, plus managing who has access
+)
+
+// Permission grants a user or a group a role on a file or folder subtree
+type Permission struct {
+	ID        string    `json:"id"`
+	FileID    string    `json:"fileId"`
+	UserID    *string   `json:"userId,omitempty"`  // Grantee user, or
+	GroupID   *string   `json:"groupId,omitempty"` // grantee group
+	Grantee   string    `json:"grantee"`           // Username or group name
+	Role      string    `json:"role"`
+	GrantedBy string    `json:"grantedBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Group is a named set of users items can be shared with
+type Group struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	OwnerID   string    `json:"ownerId"`
+	Members   []string  `json:"members"` // Usernames
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// SharedItem is an item another user has shared with the current user
+type SharedItem struct {
+	File
+	Role      string `json:"role"`
+	OwnerName string `json:"ownerName"`
+}
@@ -0,0 +1,25 @@
+package models
+
+// Quota is a user's effective storage limit
+type Quota struct {
+	PlanID   string `json:"planId"`
+	PlanName string `json:"planName"`
+	Limit    *int64 `json:"limit"` // Bytes, nil for unlimited
+}
+
+// FolderUsage is the storage used by one item of a folder, including
+// everything inside it for subfolders
+type FolderUsage struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	IsFolder  bool   `json:"isFolder"`
+	Bytes     int64  `json:"bytes"`
+	FileCount int    `json:"fileCount"`
+}
+
+// TypeUsage is the storage used by files with one extension
+type TypeUsage struct {
+	Extension string `json:"extension"` // Lower case without the dot, "" for none
+	Bytes     int64  `json:"bytes"`
+	FileCount int    `json:"fileCount"`
+}
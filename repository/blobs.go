@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// BlobRepo tracks content-addressed blobs and how many rows reference them
+type BlobRepo struct {
+	db DBTX
+}
+
+// UnreferencedBlob is a garbage collection candidate
+type UnreferencedBlob struct {
+	ID   string
+	Size int64
+}
+
+// Touch marks a blob as just used and reports whether it exists. Touching keeps
+// the garbage collector away until the caller has taken its reference.
+func (r *BlobRepo) Touch(ctx context.Context, blobID string) (bool, error) {
+	tag, err := r.db.Exec(ctx,
+		`UPDATE blobs SET last_referenced_at = NOW() WHERE id=$1`, blobID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// AddRef records one more reference to a blob, creating its row on first use
+func (r *BlobRepo) AddRef(ctx context.Context, blobID string, size int64) error {
+	_, err := r.db.Exec(ctx,
+		`INSERT INTO blobs (id, size, ref_count, created_at, last_referenced_at) VALUES ($1, $2, 1, NOW(), NOW())
+		ON CONFLICT (id) DO UPDATE SET ref_count = blobs.ref_count + 1, last_referenced_at = NOW()`,
+		blobID, size)
+	return err
+}
+
+// Release drops one reference to a blob and returns how many remain
+func (r *BlobRepo) Release(ctx context.Context, blobID string) (int, error) {
+	var remaining int
+	err := r.db.QueryRow(ctx,
+		`UPDATE blobs SET ref_count = GREATEST(ref_count - 1, 0), last_referenced_at = NOW()
+		WHERE id=$1 RETURNING ref_count`,
+		blobID).Scan(&remaining)
+	return remaining, err
+}
+
+// ListUnreferenced returns blobs no file or version points at that were last used before cutoff
+func (r *BlobRepo) ListUnreferenced(ctx context.Context, cutoff time.Time) ([]UnreferencedBlob, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT b.id, b.size FROM blobs b
+		WHERE b.last_referenced_at < $1
+		AND NOT EXISTS (SELECT 1 FROM files f WHERE f.blob_id = b.id)
+		AND NOT EXISTS (SELECT 1 FROM file_versions v WHERE v.blob_id = b.id)`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[UnreferencedBlob])
+}
+
+// LockUnreferenced locks the blob row if it is still unreferenced and unused
+// since cutoff. Must run inside a transaction.
+func (r *BlobRepo) LockUnreferenced(ctx context.Context, blobID string, cutoff time.Time) (bool, error) {
+	var locked bool
+	err := r.db.QueryRow(ctx,
+		`SELECT true FROM blobs b
+		WHERE b.id=$1 AND b.last_referenced_at < $2
+		AND NOT EXISTS (SELECT 1 FROM files f WHERE f.blob_id = b.id)
+		AND NOT EXISTS (SELECT 1 FROM file_versions v WHERE v.blob_id = b.id)
+		FOR UPDATE`, blobID, cutoff).Scan(&locked)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	return locked, err
+}
+
+// Delete removes a blob row
+func (r *BlobRepo) Delete(ctx context.Context, blobID string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM blobs WHERE id=$1`, blobID)
+	return err
+}
+
+// ListIDs returns the checksum of every known blob
+func (r *BlobRepo) ListIDs(ctx context.Context) ([]string, error) {
+	rows, err := r.db.Query(ctx, `SELECT id FROM blobs`)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
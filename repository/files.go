@@ -0,0 +1,342 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+)
+
+// FileRepo reads and writes the files table (files and folders)
+type FileRepo struct {
+	db DBTX
+}
+
+const fileColumns = `f.id, f.user_id, f.file_name, f.original_name, COALESCE(f.file_path, ''), f.blob_id,
+	f.file_size, COALESCE(f.mime_type, ''), COALESCE(f.checksum, ''), f.parent_id, f.is_folder,
+	f.is_shared, f.version, f.deleted_at, f.created_at, f.updated_at`
+
+// fileFields returns scan destinations matching fileColumns
+func fileFields(f *models.File) []any {
+	return []any{&f.ID, &f.UserID, &f.FileName, &f.OriginalName, &f.FilePath, &f.BlobID,
+		&f.FileSize, &f.MimeType, &f.Checksum, &f.ParentID, &f.IsFolder,
+		&f.IsShared, &f.Version, &f.DeletedAt, &f.CreatedAt, &f.UpdatedAt}
+}
+
+func scanFile(row pgx.Row) (*models.File, error) {
+	var f models.File
+	if err := row.Scan(fileFields(&f)...); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func scanFiles(rows pgx.Rows) ([]models.File, error) {
+	defer rows.Close()
+
+	var files []models.File
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, *f)
+	}
+	return files, rows.Err()
+}
+
+// Get returns a file or folder owned by the user that is not in the trash
+func (r *FileRepo) Get(ctx context.Context, fileID, userID string) (*models.File, error) {
+	return scanFile(r.db.QueryRow(ctx,
+		`SELECT `+fileColumns+` FROM files f WHERE f.id=$1 AND f.user_id=$2 AND f.deleted_at IS NULL`, fileID, userID))
+}
+
+// GetByID returns a live item whoever owns it; callers check access
+func (r *FileRepo) GetByID(ctx context.Context, fileID string) (*models.File, error) {
+	return scanFile(r.db.QueryRow(ctx,
+		`SELECT `+fileColumns+` FROM files f WHERE f.id=$1 AND f.deleted_at IS NULL`, fileID))
+}
+
+// List returns the user's items directly inside parentID ("" for the root)
+func (r *FileRepo) List(ctx context.Context, userID, parentID string) ([]models.File, error) {
+	var rows pgx.Rows
+	var err error
+	if parentID == "" {
+		rows, err = r.db.Query(ctx,
+			`SELECT `+fileColumns+` FROM files f WHERE f.user_id=$1 AND f.parent_id IS NULL AND f.deleted_at IS NULL
+			ORDER BY f.created_at DESC`, userID)
+	} else {
+		rows, err = r.db.Query(ctx,
+			`SELECT `+fileColumns+` FROM files f WHERE f.user_id=$1 AND f.parent_id=$2 AND f.deleted_at IS NULL
+			ORDER BY f.created_at DESC`, userID, parentID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// ListChildren returns the items directly inside a folder, folders first
+func (r *FileRepo) ListChildren(ctx context.Context, folderID string) ([]models.File, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT `+fileColumns+` FROM files f WHERE f.parent_id=$1 AND f.deleted_at IS NULL
+		ORDER BY f.is_folder DESC, f.original_name ASC`, folderID)
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// Create inserts a file or folder row
+func (r *FileRepo) Create(ctx context.Context, f *models.File) error {
+	_, err := r.db.Exec(ctx,
+		`INSERT INTO files (id, user_id, file_name, original_name, file_path, blob_id, file_size, mime_type,
+		checksum, parent_id, is_folder, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		f.ID, f.UserID, f.FileName, f.OriginalName, nullIfEmpty(f.FilePath), f.BlobID, f.FileSize,
+		nullIfEmpty(f.MimeType), nullIfEmpty(f.Checksum), f.ParentID, f.IsFolder, f.CreatedAt, f.UpdatedAt)
+	return err
+}
+
+// GetForUpdate returns the user's file and locks its row until the transaction ends
+func (r *FileRepo) GetForUpdate(ctx context.Context, fileID, userID string) (*models.File, error) {
+	return scanFile(r.db.QueryRow(ctx,
+		`SELECT `+fileColumns+` FROM files f WHERE f.id=$1 AND f.user_id=$2 AND f.deleted_at IS NULL FOR UPDATE`, fileID, userID))
+}
+
+// FindByNameForUpdate locks and returns the user's item with this name in
+// parentID (nil for the root), preferring files over folders
+func (r *FileRepo) FindByNameForUpdate(ctx context.Context, userID string, parentID *string, name string) (*models.File, error) {
+	return scanFile(r.db.QueryRow(ctx,
+		`SELECT `+fileColumns+` FROM files f
+		WHERE f.user_id=$1 AND f.parent_id IS NOT DISTINCT FROM $2 AND f.original_name=$3
+		AND f.deleted_at IS NULL
+		ORDER BY f.is_folder, f.created_at LIMIT 1 FOR UPDATE`, userID, parentID, name))
+}
+
+// SetContent points a file at new content and bumps it to the given version.
+// An empty mimeType keeps the current one.
+func (r *FileRepo) SetContent(ctx context.Context, fileID, blobID string, size int64, mimeType string, version int) error {
+	_, err := r.db.Exec(ctx,
+		`UPDATE files SET blob_id=$1, checksum=$1, file_path=NULL, file_size=$2,
+		mime_type=COALESCE($3, mime_type), version=$4, updated_at=NOW()
+		WHERE id=$5`, blobID, size, nullIfEmpty(mimeType), version, fileID)
+	return err
+}
+
+// LockTree serializes changes to the user's folder structure (moves, copies,
+// name checks) until the surrounding transaction ends
+func (r *FileRepo) LockTree(ctx context.Context, userID string) error {
+	_, err := r.db.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('files:' || $1))`, userID)
+	return err
+}
+
+// NameExists reports whether parentID (nil for the root) already holds an
+// item other than excludeID with this name
+func (r *FileRepo) NameExists(ctx context.Context, userID string, parentID *string, name, excludeID string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM files WHERE user_id=$1 AND parent_id IS NOT DISTINCT FROM $2
+		AND original_name=$3 AND id<>$4 AND deleted_at IS NULL)`,
+		userID, parentID, name, excludeID).Scan(&exists)
+	return exists, err
+}
+
+// IsWithin reports whether candidateID is folderID itself or one of its descendants
+func (r *FileRepo) IsWithin(ctx context.Context, candidateID, folderID string) (bool, error) {
+	var within bool
+	err := r.db.QueryRow(ctx,
+		`WITH RECURSIVE ancestors AS (
+			SELECT id, parent_id FROM files WHERE id=$1
+			UNION ALL
+			SELECT f.id, f.parent_id FROM files f JOIN ancestors a ON f.id = a.parent_id
+		)
+		SELECT EXISTS (SELECT 1 FROM ancestors WHERE id=$2)`, candidateID, folderID).Scan(&within)
+	return within, err
+}
+
+// GetWithin returns the live item fileID if it is folderID itself or one of
+// its live descendants, and pgx.ErrNoRows otherwise
+func (r *FileRepo) GetWithin(ctx context.Context, fileID, folderID string) (*models.File, error) {
+	return scanFile(r.db.QueryRow(ctx,
+		`WITH RECURSIVE ancestors AS (
+			SELECT id, parent_id FROM files WHERE id=$1 AND deleted_at IS NULL
+			UNION ALL
+			SELECT f.id, f.parent_id FROM files f JOIN ancestors a ON f.id = a.parent_id
+			WHERE f.deleted_at IS NULL AND a.id <> $2
+		)
+		SELECT `+fileColumns+` FROM files f
+		WHERE f.id=$1 AND EXISTS (SELECT 1 FROM ancestors WHERE id=$2)`, fileID, folderID))
+}
+
+// FindChildFolder returns the live folder called name directly inside parentID
+func (r *FileRepo) FindChildFolder(ctx context.Context, parentID, name string) (*models.File, error) {
+	return scanFile(r.db.QueryRow(ctx,
+		`SELECT `+fileColumns+` FROM files f
+		WHERE f.parent_id=$1 AND f.original_name=$2 AND f.is_folder AND f.deleted_at IS NULL
+		ORDER BY f.created_at LIMIT 1`, parentID, name))
+}
+
+// Move renames an item and/or moves it to parentID (nil for the root).
+// Stored file names are derived from the file ID, so only folders get a new file_name.
+func (r *FileRepo) Move(ctx context.Context, fileID, name string, parentID *string) error {
+	_, err := r.db.Exec(ctx,
+		`UPDATE files SET original_name=$1, file_name=CASE WHEN is_folder THEN $1 ELSE file_name END,
+		parent_id=$2, updated_at=NOW() WHERE id=$3`, name, parentID, fileID)
+	return err
+}
+
+// Subtree returns a live item and all its live descendants, parents before children
+func (r *FileRepo) Subtree(ctx context.Context, fileID string) ([]models.File, error) {
+	rows, err := r.db.Query(ctx,
+		`WITH RECURSIVE subtree AS (
+			SELECT id, 0 AS depth FROM files WHERE id=$1 AND deleted_at IS NULL
+			UNION ALL
+			SELECT f.id, s.depth + 1 FROM files f JOIN subtree s ON f.parent_id = s.id WHERE f.deleted_at IS NULL
+		)
+		SELECT `+fileColumns+` FROM files f JOIN subtree s ON f.id = s.id
+		ORDER BY s.depth, f.original_name`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// Trash moves the user's file, and for folders every descendant not already
+// in the trash, to the trash with a single shared timestamp
+func (r *FileRepo) Trash(ctx context.Context, fileID, userID string) error {
+	tag, err := r.db.Exec(ctx,
+		`WITH RECURSIVE subtree AS (
+			SELECT id FROM files WHERE id=$1 AND user_id=$2 AND deleted_at IS NULL
+			UNION ALL
+			SELECT f.id FROM files f JOIN subtree s ON f.parent_id = s.id WHERE f.deleted_at IS NULL
+		)
+		UPDATE files SET deleted_at=NOW() WHERE id IN (SELECT id FROM subtree)`, fileID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// ListTrash returns the items the user deleted, newest first. Descendants
+// trashed together with their folder are left out; they come back with it.
+func (r *FileRepo) ListTrash(ctx context.Context, userID string) ([]models.File, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT `+fileColumns+` FROM files f LEFT JOIN files p ON p.id = f.parent_id
+		WHERE f.user_id=$1 AND f.deleted_at IS NOT NULL AND p.deleted_at IS DISTINCT FROM f.deleted_at
+		ORDER BY f.deleted_at DESC, f.original_name ASC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// GetTrashedForUpdate returns the user's trashed item and locks its row
+func (r *FileRepo) GetTrashedForUpdate(ctx context.Context, fileID, userID string) (*models.File, error) {
+	return scanFile(r.db.QueryRow(ctx,
+		`SELECT `+fileColumns+` FROM files f WHERE f.id=$1 AND f.user_id=$2 AND f.deleted_at IS NOT NULL
+		FOR UPDATE`, fileID, userID))
+}
+
+// Restore takes a trashed item and everything trashed along with it out of
+// the trash. If its folder is no longer available the item is moved to the
+// root, which is reported by the returned bool.
+func (r *FileRepo) Restore(ctx context.Context, fileID string) (bool, error) {
+	_, err := r.db.Exec(ctx,
+		`WITH RECURSIVE subtree AS (
+			SELECT id, deleted_at FROM files WHERE id=$1 AND deleted_at IS NOT NULL
+			UNION ALL
+			SELECT f.id, f.deleted_at FROM files f JOIN subtree s ON f.parent_id = s.id
+			WHERE f.deleted_at = s.deleted_at
+		)
+		UPDATE files SET deleted_at=NULL, updated_at=NOW() WHERE id IN (SELECT id FROM subtree)`, fileID)
+	if err != nil {
+		return false, err
+	}
+
+	tag, err := r.db.Exec(ctx,
+		`UPDATE files SET parent_id=NULL WHERE id=$1 AND parent_id IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM files p WHERE p.id = files.parent_id AND p.deleted_at IS NULL)`, fileID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// ExpiredTrash identifies a trashed item due for purging
+type ExpiredTrash struct {
+	ID     string
+	UserID string
+}
+
+// ListExpiredTrash returns the trashed items deleted before cutoff whose
+// folder isn't itself due, so purging each one covers the whole set
+func (r *FileRepo) ListExpiredTrash(ctx context.Context, cutoff time.Time) ([]ExpiredTrash, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT f.id, f.user_id FROM files f LEFT JOIN files p ON p.id = f.parent_id
+		WHERE f.deleted_at < $1 AND (p.deleted_at IS NULL OR p.deleted_at >= $1)`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[ExpiredTrash])
+}
+
+// SubtreeBlobIDs returns the blob of the file and of every descendant, one
+// entry per referencing row
+func (r *FileRepo) SubtreeBlobIDs(ctx context.Context, fileID string) ([]string, error) {
+	rows, err := r.db.Query(ctx,
+		`WITH RECURSIVE subtree AS (
+			SELECT id, blob_id FROM files WHERE id=$1
+			UNION ALL
+			SELECT f.id, f.blob_id FROM files f JOIN subtree s ON f.parent_id = s.id
+		)
+		SELECT blob_id FROM subtree WHERE blob_id IS NOT NULL
+		UNION ALL
+		SELECT v.blob_id FROM file_versions v JOIN subtree s ON v.file_id = s.id WHERE v.blob_id IS NOT NULL`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// Purge permanently removes the user's trashed item; parent_id cascades the
+// delete to descendants. It returns the blob of every deleted file and
+// version row so the caller can release those references.
+func (r *FileRepo) Purge(ctx context.Context, fileID, userID string) ([]string, error) {
+	// Collect first, the cascade leaves nothing to collect afterwards
+	blobIDs, err := r.SubtreeBlobIDs(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	tag, err := r.db.Exec(ctx,
+		`DELETE FROM files WHERE id=$1 AND user_id=$2 AND deleted_at IS NOT NULL`, fileID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, pgx.ErrNoRows
+	}
+	return blobIDs, nil
+}
+
+// SetShared updates the is_shared flag
+func (r *FileRepo) SetShared(ctx context.Context, fileID string, shared bool) error {
+	_, err := r.db.Exec(ctx, `UPDATE files SET is_shared=$1 WHERE id=$2`, shared, fileID)
+	return err
+}
+
+// LegacyPaths returns every file_path still recorded by file or version rows that predate the blob store
+func (r *FileRepo) LegacyPaths(ctx context.Context) ([]string, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT file_path FROM files WHERE file_path IS NOT NULL
+		UNION SELECT file_path FROM file_versions WHERE file_path IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+)
+
+// GroupRepo reads and writes groups of users
+type GroupRepo struct {
+	db DBTX
+}
+
+const groupColumns = `g.id, g.name, g.owner_id,
+	ARRAY(SELECT u.username FROM group_members m JOIN users u ON u.id = m.user_id
+		WHERE m.group_id = g.id ORDER BY u.username),
+	g.created_at`
+
+// Create inserts a group
+func (r *GroupRepo) Create(ctx context.Context, g *models.Group) error {
+	_, err := r.db.Exec(ctx,
+		`INSERT INTO groups (id, name, owner_id, created_at) VALUES ($1, $2, $3, $4)`,
+		g.ID, g.Name, g.OwnerID, g.CreatedAt)
+	return err
+}
+
+// Get returns a group with its members
+func (r *GroupRepo) Get(ctx context.Context, groupID string) (*models.Group, error) {
+	rows, err := r.db.Query(ctx, `SELECT `+groupColumns+` FROM groups g WHERE g.id=$1`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByPos[models.Group])
+}
+
+// ListForUser returns the groups the user owns or belongs to
+func (r *GroupRepo) ListForUser(ctx context.Context, userID string) ([]models.Group, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT `+groupColumns+` FROM groups g
+		WHERE g.owner_id=$1 OR EXISTS (SELECT 1 FROM group_members m WHERE m.group_id = g.id AND m.user_id=$1)
+		ORDER BY g.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[models.Group])
+}
+
+// AddMember adds a user to a group; adding an existing member is a no-op
+func (r *GroupRepo) AddMember(ctx context.Context, groupID, userID string) error {
+	_, err := r.db.Exec(ctx,
+		`INSERT INTO group_members (group_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, groupID, userID)
+	return err
+}
+
+// RemoveMember removes a user from a group
+func (r *GroupRepo) RemoveMember(ctx context.Context, groupID, userID string) error {
+	tag, err := r.db.Exec(ctx, `DELETE FROM group_members WHERE group_id=$1 AND user_id=$2`, groupID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
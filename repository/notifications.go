@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+)
+
+// NotificationRepo reads and writes users' notifications
+type NotificationRepo struct {
+	db DBTX
+}
+
+const notificationColumns = `id, user_id, kind, message, share_id, file_id, read_at, created_at`
+
+// Create adds a notification for its user
+func (r *NotificationRepo) Create(ctx context.Context, n *models.Notification) error {
+	_, err := r.db.Exec(ctx,
+		`INSERT INTO notifications (id, user_id, kind, message, share_id, file_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		n.ID, n.UserID, n.Kind, n.Message, n.ShareID, n.FileID, n.CreatedAt)
+	return err
+}
+
+// List returns up to limit of the user's notifications, newest first, only
+// the unread ones when unreadOnly is set
+func (r *NotificationRepo) List(ctx context.Context, userID string, unreadOnly bool, limit int) ([]models.Notification, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT `+notificationColumns+` FROM notifications
+		WHERE user_id=$1 AND (NOT $2 OR read_at IS NULL)
+		ORDER BY created_at DESC LIMIT $3`, userID, unreadOnly, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[models.Notification])
+}
+
+// CountUnread returns how many of the user's notifications are unread
+func (r *NotificationRepo) CountUnread(ctx context.Context, userID string) (int, error) {
+	var count int
+	err := r.db.QueryRow(ctx,
+		`SELECT COUNT(*) FROM notifications WHERE user_id=$1 AND read_at IS NULL`, userID).Scan(&count)
+	return count, err
+}
+
+// MarkRead marks one of the user's notifications read, returning
+// pgx.ErrNoRows if they have no such notification
+func (r *NotificationRepo) MarkRead(ctx context.Context, notificationID, userID string) error {
+	tag, err := r.db.Exec(ctx,
+		`UPDATE notifications SET read_at=COALESCE(read_at, NOW()) WHERE id=$1 AND user_id=$2`,
+		notificationID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// MarkAllRead marks every unread notification of the user read, returning
+// how many there were
+func (r *NotificationRepo) MarkAllRead(ctx context.Context, userID string) (int64, error) {
+	tag, err := r.db.Exec(ctx,
+		`UPDATE notifications SET read_at=NOW() WHERE user_id=$1 AND read_at IS NULL`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+)
+
+// PermissionRepo reads and writes grants of roles on files and folders
+type PermissionRepo struct {
+	db DBTX
+}
+
+// roleRank orders file_permissions.role (aliased p) from viewer up to owner
+const roleRank = `array_position(ARRAY['viewer', 'commenter', 'editor', 'owner'], p.role)`
+
+// grantedTo matches grants (aliased p) to the user in $2 or a group they are in
+const grantedTo = `(p.user_id=$2 OR p.group_id IN (SELECT group_id FROM group_members WHERE user_id=$2))`
+
+const permissionColumns = `p.id, p.file_id, p.user_id, p.group_id, COALESCE(u.username, g.name, ''),
+	p.role, p.granted_by, p.created_at`
+
+// Grant gives the grantee in p its role on the file, replacing the role of
+// an existing grant to the same user or group
+func (r *PermissionRepo) Grant(ctx context.Context, p *models.Permission) error {
+	conflict := `(file_id, user_id) WHERE user_id IS NOT NULL`
+	if p.GroupID != nil {
+		conflict = `(file_id, group_id) WHERE group_id IS NOT NULL`
+	}
+	return r.db.QueryRow(ctx,
+		`INSERT INTO file_permissions (id, file_id, user_id, group_id, role, granted_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT `+conflict+` DO UPDATE SET role=EXCLUDED.role, granted_by=EXCLUDED.granted_by
+		RETURNING id, created_at`,
+		p.ID, p.FileID, p.UserID, p.GroupID, p.Role, p.GrantedBy, p.CreatedAt).Scan(&p.ID, &p.CreatedAt)
+}
+
+// List returns the grants made directly on a file
+func (r *PermissionRepo) List(ctx context.Context, fileID string) ([]models.Permission, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT `+permissionColumns+` FROM file_permissions p
+		LEFT JOIN users u ON u.id = p.user_id
+		LEFT JOIN groups g ON g.id = p.group_id
+		WHERE p.file_id=$1
+		ORDER BY p.created_at`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[models.Permission])
+}
+
+// Revoke removes a grant made on a file
+func (r *PermissionRepo) Revoke(ctx context.Context, permissionID, fileID string) error {
+	tag, err := r.db.Exec(ctx, `DELETE FROM file_permissions WHERE id=$1 AND file_id=$2`, permissionID, fileID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// Role returns the highest role granted to the user, directly or through a
+// group, on the item or any folder above it, or "" if there is none. It
+// doesn't consider ownership of the item itself.
+func (r *PermissionRepo) Role(ctx context.Context, fileID, userID string) (string, error) {
+	var role string
+	err := r.db.QueryRow(ctx,
+		`WITH RECURSIVE ancestors AS (
+			SELECT id, parent_id FROM files WHERE id=$1
+			UNION ALL
+			SELECT f.id, f.parent_id FROM files f JOIN ancestors a ON f.id = a.parent_id
+		)
+		SELECT p.role FROM file_permissions p JOIN ancestors a ON p.file_id = a.id
+		WHERE `+grantedTo+`
+		ORDER BY `+roleRank+` DESC LIMIT 1`, fileID, userID).Scan(&role)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// SharedWith returns the live items other users have granted the user (or
+// one of their groups) a role on, with the highest such role
+func (r *PermissionRepo) SharedWith(ctx context.Context, userID string) ([]models.SharedItem, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT `+fileColumns+`, r.role, u.username
+		FROM files f
+		JOIN users u ON u.id = f.user_id
+		JOIN LATERAL (
+			SELECT p.role FROM file_permissions p
+			WHERE p.file_id = f.id AND (p.user_id=$1 OR p.group_id IN (SELECT group_id FROM group_members WHERE user_id=$1))
+			ORDER BY `+roleRank+` DESC LIMIT 1
+		) r ON TRUE
+		WHERE f.user_id <> $1 AND f.deleted_at IS NULL
+		ORDER BY f.is_folder DESC, f.original_name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []models.SharedItem
+	for rows.Next() {
+		var item models.SharedItem
+		if err := rows.Scan(append(fileFields(&item.File), &item.Role, &item.OwnerName)...); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DBTX is the query interface shared by *pgxpool.Pool and pgx.Tx, so every
+// repo method works both standalone and inside a transaction
+type DBTX interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Repository groups the per-table repos around one pool or transaction
+type Repository struct {
+	pool *pgxpool.Pool
+	db   DBTX
+
+	Users    *UserRepo
+	Files    *FileRepo
+	Shares   *ShareRepo
+	Uploads  *UploadRepo
+	Blobs    *BlobRepo
+	Versions *VersionRepo
+	Usage    *UsageRepo
+
+	Permissions   *PermissionRepo
+	Groups        *GroupRepo
+	Notifications *NotificationRepo
+}
+
+// New creates a repository backed by the connection pool
+func New(pool *pgxpool.Pool) *Repository {
+	return newRepository(pool, pool)
+}
+
+func newRepository(pool *pgxpool.Pool, db DBTX) *Repository {
+	return &Repository{
+		pool:     pool,
+		db:       db,
+		Users:    &UserRepo{db: db},
+		Files:    &FileRepo{db: db},
+		Shares:   &ShareRepo{db: db},
+		Uploads:  &UploadRepo{db: db},
+		Blobs:    &BlobRepo{db: db},
+		Versions: &VersionRepo{db: db},
+		Usage:    &UsageRepo{db: db},
+
+		Permissions:   &PermissionRepo{db: db},
+		Groups:        &GroupRepo{db: db},
+		Notifications: &NotificationRepo{db: db},
+	}
+}
+
+// WithTx runs fn with a repository bound to a single transaction, committing
+// if fn returns nil and rolling back otherwise. Calls made on a repository
+// that is already inside a transaction join it.
+func (r *Repository) WithTx(ctx context.Context, fn func(tx *Repository) error) error {
+	if _, inTx := r.db.(pgx.Tx); inTx {
+		return fn(r)
+	}
+
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(newRepository(r.pool, tx)); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// PurgeTrashed permanently deletes the user's trashed item, with everything
+// trashed inside it, and releases the blob references they held; the bytes
+// are removed later by the garbage collector. With deletedBefore set, an
+// item trashed again since then is left alone as pgx.ErrNoRows. Call it
+// inside a transaction.
+func (r *Repository) PurgeTrashed(ctx context.Context, fileID, userID string, deletedBefore *time.Time) error {
+	// Lock the row so concurrent purges can't release the same references twice
+	file, err := r.Files.GetTrashedForUpdate(ctx, fileID, userID)
+	if err != nil {
+		return err
+	}
+	if deletedBefore != nil && !file.DeletedAt.Before(*deletedBefore) {
+		return pgx.ErrNoRows
+	}
+
+	blobIDs, err := r.Files.Purge(ctx, fileID, userID)
+	if err != nil {
+		return err
+	}
+	for _, blobID := range blobIDs {
+		if _, err := r.Blobs.Release(ctx, blobID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nullIfEmpty maps "" to SQL NULL for optional text columns
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
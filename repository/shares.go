@@ -0,0 +1,341 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+)
+
+// ShareRepo reads and writes share links
+type ShareRepo struct {
+	db DBTX
+}
+
+// SharedFile is a share link together with the file or folder it points at
+type SharedFile struct {
+	Share models.ShareLink
+	File  models.File
+}
+
+const shareColumns = `sl.id, sl.file_id, sl.user_id, sl.token, sl.expires_at, sl.password, sl.created_at,
+	sl.kind, sl.max_file_size, COALESCE(sl.allowed_extensions, '{}'), sl.require_uploader_info,
+	sl.max_downloads, sl.download_count, sl.on_change, sl.pinned_version, sl.pinned_checksum,
+	sl.revoked_at, COALESCE(sl.revoked_reason, '')`
+
+func shareFields(s *models.ShareLink) []any {
+	return []any{&s.ID, &s.FileID, &s.UserID, &s.Token, &s.ExpiresAt, &s.Password, &s.CreatedAt,
+		&s.Kind, &s.MaxFileSize, &s.AllowedExtensions, &s.RequireUploaderInfo, &s.MaxDownloads, &s.DownloadCount,
+		&s.OnChange, &s.PinnedVersion, &s.PinnedChecksum, &s.RevokedAt, &s.RevokedReason}
+}
+
+func scanSharedFile(row pgx.Row) (*SharedFile, error) {
+	var s SharedFile
+	if err := row.Scan(append(shareFields(&s.Share), fileFields(&s.File)...)...); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func scanSharedFiles(rows pgx.Rows) ([]SharedFile, error) {
+	defer rows.Close()
+
+	var shares []SharedFile
+	for rows.Next() {
+		s, err := scanSharedFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, *s)
+	}
+	return shares, rows.Err()
+}
+
+// Create inserts a share link
+func (r *ShareRepo) Create(ctx context.Context, s *models.ShareLink) error {
+	_, err := r.db.Exec(ctx,
+		`INSERT INTO share_links (id, file_id, user_id, token, expires_at, password, created_at,
+		kind, max_file_size, allowed_extensions, require_uploader_info, max_downloads,
+		on_change, pinned_version, pinned_checksum)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+		s.ID, s.FileID, s.UserID, s.Token, s.ExpiresAt, s.Password, s.CreatedAt,
+		s.Kind, s.MaxFileSize, s.AllowedExtensions, s.RequireUploaderInfo, s.MaxDownloads,
+		s.OnChange, s.PinnedVersion, s.PinnedChecksum)
+	return err
+}
+
+// GetByToken looks up a share link and its file by public token
+func (r *ShareRepo) GetByToken(ctx context.Context, token string) (*SharedFile, error) {
+	return scanSharedFile(r.db.QueryRow(ctx,
+		`SELECT `+shareColumns+`, `+fileColumns+`
+		FROM share_links sl
+		JOIN files f ON sl.file_id = f.id
+		WHERE sl.token=$1 AND f.deleted_at IS NULL`, token))
+}
+
+// ListByUser returns every share link the user created, newest first
+func (r *ShareRepo) ListByUser(ctx context.Context, userID string) ([]SharedFile, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT `+shareColumns+`, `+fileColumns+`
+		FROM share_links sl
+		JOIN files f ON sl.file_id = f.id
+		WHERE sl.user_id=$1
+		ORDER BY sl.created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanSharedFiles(rows)
+}
+
+// GetOwned returns a share link created by the user
+func (r *ShareRepo) GetOwned(ctx context.Context, shareID, userID string) (*models.ShareLink, error) {
+	var s models.ShareLink
+	err := r.db.QueryRow(ctx,
+		`SELECT `+shareColumns+` FROM share_links sl WHERE sl.id=$1 AND sl.user_id=$2`,
+		shareID, userID).Scan(shareFields(&s)...)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Delete removes a share link created by the user
+func (r *ShareRepo) Delete(ctx context.Context, shareID, userID string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM share_links WHERE id=$1 AND user_id=$2`, shareID, userID)
+	return err
+}
+
+// CountForFile returns how many share links point at a file
+func (r *ShareRepo) CountForFile(ctx context.Context, fileID string) (int, error) {
+	var count int
+	err := r.db.QueryRow(ctx, `SELECT COUNT(*) FROM share_links WHERE file_id=$1`, fileID).Scan(&count)
+	return count, err
+}
+
+// SetExpiry changes when the link expires (nil never expires)
+func (r *ShareRepo) SetExpiry(ctx context.Context, shareID string, expiresAt *time.Time) error {
+	_, err := r.db.Exec(ctx, `UPDATE share_links SET expires_at=$1 WHERE id=$2`, expiresAt, shareID)
+	return err
+}
+
+// SetPassword changes the bcrypt hash protecting the link (nil removes it)
+func (r *ShareRepo) SetPassword(ctx context.Context, shareID string, hashedPassword *string) error {
+	_, err := r.db.Exec(ctx, `UPDATE share_links SET password=$1 WHERE id=$2`, hashedPassword, shareID)
+	return err
+}
+
+// RevokeOnChange revokes the live revoke-on-change links affected by a
+// change to fileID: links on the item itself and on every folder above it,
+// and with withDescendants (for an item about to go to the trash) on every
+// live item below it. It returns the revoked links with their items.
+func (r *ShareRepo) RevokeOnChange(ctx context.Context, fileID string, withDescendants bool, reason string) ([]SharedFile, error) {
+	return r.revoke(ctx,
+		`above AS (
+			SELECT id, parent_id FROM files WHERE id=$2
+			UNION ALL
+			SELECT f.id, f.parent_id FROM files f JOIN above a ON f.id = a.parent_id
+		), below AS (
+			SELECT id FROM files WHERE id=$2 AND $3::boolean
+			UNION ALL
+			SELECT f.id FROM files f JOIN below b ON f.parent_id = b.id WHERE f.deleted_at IS NULL
+		), affected AS (
+			SELECT id FROM above UNION SELECT id FROM below
+		)`, reason, fileID, withDescendants)
+}
+
+// RevokeOnMoveOut revokes the live revoke-on-change links on the folders
+// fileID is about to leave when it moves to newParentID (nil for the root):
+// those above it now that won't be above it there. Links on the item itself
+// keep working, since its content doesn't change.
+func (r *ShareRepo) RevokeOnMoveOut(ctx context.Context, fileID string, newParentID *string, reason string) ([]SharedFile, error) {
+	return r.revoke(ctx,
+		`leaving AS (
+			SELECT id, parent_id FROM files WHERE id = (SELECT parent_id FROM files WHERE id=$2)
+			UNION ALL
+			SELECT f.id, f.parent_id FROM files f JOIN leaving l ON f.id = l.parent_id
+		), staying AS (
+			SELECT id, parent_id FROM files WHERE id=$3
+			UNION ALL
+			SELECT f.id, f.parent_id FROM files f JOIN staying s ON f.id = s.parent_id
+		), affected AS (
+			SELECT id FROM leaving EXCEPT SELECT id FROM staying
+		)`, reason, fileID, newParentID)
+}
+
+// revoke revokes the live revoke-on-change links on the items selected by
+// the affected CTE, which can use args from $2 on
+func (r *ShareRepo) revoke(ctx context.Context, affected, reason string, args ...any) ([]SharedFile, error) {
+	rows, err := r.db.Query(ctx,
+		`WITH RECURSIVE `+affected+`
+		UPDATE share_links sl SET revoked_at=NOW(), revoked_reason=$1
+		FROM files f
+		WHERE f.id = sl.file_id AND sl.on_change='revoke' AND sl.revoked_at IS NULL
+		AND sl.file_id IN (SELECT id FROM affected)
+		RETURNING `+shareColumns+`, `+fileColumns, append([]any{reason}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	return scanSharedFiles(rows)
+}
+
+// SetMaxDownloads changes how many downloads the link allows (nil for no limit)
+func (r *ShareRepo) SetMaxDownloads(ctx context.Context, shareID string, maxDownloads *int) error {
+	_, err := r.db.Exec(ctx, `UPDATE share_links SET max_downloads=$1 WHERE id=$2`, maxDownloads, shareID)
+	return err
+}
+
+// ClaimDownload counts one download against the link's limit. It returns
+// pgx.ErrNoRows once the limit has been reached, so concurrent requests
+// can't download more often than allowed.
+func (r *ShareRepo) ClaimDownload(ctx context.Context, shareID string) error {
+	tag, err := r.db.Exec(ctx,
+		`UPDATE share_links SET download_count = download_count + 1
+		WHERE id=$1 AND (max_downloads IS NULL OR download_count < max_downloads)`, shareID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+const accessColumns = `id, share_id, file_id, action, outcome, COALESCE(reason, ''), COALESCE(ip, ''),
+	COALESCE(user_agent, ''), bytes_served, created_at`
+
+// LogAccess records a use of a share link
+func (r *ShareRepo) LogAccess(ctx context.Context, a *models.ShareAccess) error {
+	_, err := r.db.Exec(ctx,
+		`INSERT INTO share_access_log (id, share_id, file_id, action, outcome, reason, ip, user_agent, bytes_served, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		a.ID, a.ShareID, a.FileID, a.Action, a.Outcome, nullIfEmpty(a.Reason), nullIfEmpty(a.IP),
+		nullIfEmpty(a.UserAgent), a.BytesServed, a.CreatedAt)
+	return err
+}
+
+// ListAccess returns up to limit uses of a share link from before the given
+// time, newest first
+func (r *ShareRepo) ListAccess(ctx context.Context, shareID string, before time.Time, limit int) ([]models.ShareAccess, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT `+accessColumns+` FROM share_access_log
+		WHERE share_id=$1 AND created_at < $2
+		ORDER BY created_at DESC LIMIT $3`, shareID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[models.ShareAccess])
+}
+
+// StatsByUser sums up the access log of every share link the user created,
+// keyed by share ID. Links that were never used are left out.
+func (r *ShareRepo) StatsByUser(ctx context.Context, userID string) (map[string]models.ShareStats, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT a.share_id,
+			COUNT(*) FILTER (WHERE a.outcome='success' AND a.action='view'),
+			COUNT(*) FILTER (WHERE a.outcome='success' AND a.action IN ('download', 'archive')),
+			COUNT(*) FILTER (WHERE a.outcome='success' AND a.action='upload'),
+			COUNT(*) FILTER (WHERE a.outcome='denied'),
+			COALESCE(SUM(a.bytes_served) FILTER (WHERE a.action <> 'upload'), 0),
+			MAX(a.created_at)
+		FROM share_access_log a
+		JOIN share_links sl ON a.share_id = sl.id
+		WHERE sl.user_id=$1
+		GROUP BY a.share_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := map[string]models.ShareStats{}
+	for rows.Next() {
+		var shareID string
+		var s models.ShareStats
+		if err := rows.Scan(&shareID, &s.Views, &s.Downloads, &s.Uploads, &s.Denied, &s.BytesServed, &s.LastAccessedAt); err != nil {
+			return nil, err
+		}
+		stats[shareID] = s
+	}
+	return stats, rows.Err()
+}
+
+// ReserveUnlockAttempt counts a password attempt against key before the
+// password is checked, in one statement so concurrent attempts can't all
+// get past the limit. Attempts before windowStart no longer count, and the
+// attempt that would go over limit locks the key until lockUntil and starts
+// its count over. A locked key isn't counted against. It returns the
+// attempts now counted and, while the key is locked, until when.
+func (r *ShareRepo) ReserveUnlockAttempt(ctx context.Context, key string, windowStart time.Time, limit int, lockUntil time.Time) (int, *time.Time, error) {
+	var attempts int
+	var lockedUntil *time.Time
+	err := r.db.QueryRow(ctx,
+		`INSERT INTO share_unlock_attempts AS a (key, failures, window_start) VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN a.locked_until > NOW() THEN a.failures
+				WHEN a.window_start < $2 THEN 1
+				WHEN a.failures >= $3 THEN 0
+				ELSE a.failures + 1 END,
+			window_start = CASE
+				WHEN a.locked_until > NOW() THEN a.window_start
+				WHEN a.window_start < $2 OR a.failures >= $3 THEN NOW()
+				ELSE a.window_start END,
+			locked_until = CASE
+				WHEN a.locked_until > NOW() THEN a.locked_until
+				WHEN a.window_start >= $2 AND a.failures >= $3 THEN $4
+				ELSE a.locked_until END
+		RETURNING failures, CASE WHEN locked_until > NOW() THEN locked_until END`,
+		key, windowStart, limit, lockUntil).Scan(&attempts, &lockedUntil)
+	return attempts, lockedUntil, err
+}
+
+// ReleaseUnlockAttempt takes back an attempt reserved against key that
+// turned out not to be a failure
+func (r *ShareRepo) ReleaseUnlockAttempt(ctx context.Context, key string) error {
+	_, err := r.db.Exec(ctx,
+		`UPDATE share_unlock_attempts SET failures = GREATEST(failures - 1, 0) WHERE key=$1`, key)
+	return err
+}
+
+// LockUnlockAttempts locks key out of password attempts until lockUntil and
+// starts its count over
+func (r *ShareRepo) LockUnlockAttempts(ctx context.Context, key string, lockUntil time.Time) error {
+	_, err := r.db.Exec(ctx,
+		`UPDATE share_unlock_attempts SET locked_until=$1, failures=0, window_start=NOW() WHERE key=$2`,
+		lockUntil, key)
+	return err
+}
+
+// ClearUnlockFailures forgets the failed attempts counted against key
+func (r *ShareRepo) ClearUnlockFailures(ctx context.Context, key string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM share_unlock_attempts WHERE key=$1`, key)
+	return err
+}
+
+// PurgeUnlockAttempts removes attempt counters whose window started before
+// windowStart and that aren't locked, returning how many were removed
+func (r *ShareRepo) PurgeUnlockAttempts(ctx context.Context, windowStart time.Time) (int64, error) {
+	tag, err := r.db.Exec(ctx,
+		`DELETE FROM share_unlock_attempts
+		WHERE window_start < $1 AND (locked_until IS NULL OR locked_until <= NOW())`, windowStart)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// ListRequestUploads returns the files received through a file request
+// link, newest first
+func (r *ShareRepo) ListRequestUploads(ctx context.Context, shareID string) ([]models.FileRequestUpload, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT cu.id, f.id, f.original_name, f.file_size, COALESCE(cu.uploader_name, ''),
+		COALESCE(cu.uploader_email, ''), f.created_at
+		FROM chunk_uploads cu
+		JOIN files f ON cu.file_id = f.id
+		WHERE cu.share_id=$1 AND cu.status='completed' AND f.deleted_at IS NULL
+		ORDER BY f.created_at DESC`, shareID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[models.FileRequestUpload])
+}
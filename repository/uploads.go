@@ -0,0 +1,233 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+)
+
+// UploadRepo reads and writes chunked upload sessions
+type UploadRepo struct {
+	db DBTX
+}
+
+const uploadColumns = `id, user_id, file_name, total_chunks, chunk_size, total_size,
+	uploaded_chunks, status, file_id, protocol, upload_offset, COALESCE(metadata, ''),
+	COALESCE(expected_checksum, ''), COALESCE(error, ''), parent_id, COALESCE(on_conflict, ''), share_id,
+	COALESCE(uploader_name, ''), COALESCE(uploader_email, ''), created_at, expires_at, owner_id`
+
+const partColumns = `upload_id, chunk_number, size, checksum, created_at`
+
+func scanUpload(row pgx.Row) (*models.ChunkUpload, error) {
+	var u models.ChunkUpload
+	err := row.Scan(&u.ID, &u.UserID, &u.FileName, &u.TotalChunks, &u.ChunkSize, &u.TotalSize,
+		&u.UploadedChunks, &u.Status, &u.FileID, &u.Protocol, &u.Offset, &u.Metadata,
+		&u.ExpectedChecksum, &u.Error, &u.ParentID, &u.OnConflict, &u.ShareID,
+		&u.UploaderName, &u.UploaderEmail, &u.CreatedAt, &u.ExpiresAt, &u.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Create starts a new upload session
+func (r *UploadRepo) Create(ctx context.Context, u *models.ChunkUpload) error {
+	_, err := r.db.Exec(ctx,
+		`INSERT INTO chunk_uploads (id, user_id, file_name, total_chunks, chunk_size, total_size, status, file_id,
+		protocol, metadata, expected_checksum, parent_id, on_conflict, share_id, uploader_name, uploader_email,
+		created_at, expires_at, owner_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)`,
+		u.ID, u.UserID, u.FileName, u.TotalChunks, u.ChunkSize, u.TotalSize, u.Status, u.FileID,
+		u.Protocol, nullIfEmpty(u.Metadata), nullIfEmpty(u.ExpectedChecksum), u.ParentID, nullIfEmpty(u.OnConflict),
+		u.ShareID, nullIfEmpty(u.UploaderName), nullIfEmpty(u.UploaderEmail), u.CreatedAt, u.ExpiresAt, u.OwnerID)
+	return err
+}
+
+// Get returns the user's upload session regardless of its state
+func (r *UploadRepo) Get(ctx context.Context, uploadID, userID string) (*models.ChunkUpload, error) {
+	return scanUpload(r.db.QueryRow(ctx,
+		`SELECT `+uploadColumns+` FROM chunk_uploads WHERE id=$1 AND user_id=$2`, uploadID, userID))
+}
+
+// GetActive returns the user's session if it still accepts chunks
+func (r *UploadRepo) GetActive(ctx context.Context, uploadID, userID string) (*models.ChunkUpload, error) {
+	return scanUpload(r.db.QueryRow(ctx,
+		`SELECT `+uploadColumns+` FROM chunk_uploads
+		WHERE id=$1 AND user_id=$2 AND status IN ('pending', 'uploading') AND expires_at > NOW()`,
+		uploadID, userID))
+}
+
+// GetActiveForUpdate returns the user's active session and locks it until
+// the transaction ends, so appends to the same session run one at a time
+func (r *UploadRepo) GetActiveForUpdate(ctx context.Context, uploadID, userID string) (*models.ChunkUpload, error) {
+	return scanUpload(r.db.QueryRow(ctx,
+		`SELECT `+uploadColumns+` FROM chunk_uploads
+		WHERE id=$1 AND user_id=$2 AND status IN ('pending', 'uploading') AND expires_at > NOW()
+		FOR UPDATE`, uploadID, userID))
+}
+
+// IsActive reports whether any session with this ID still accepts chunks or
+// is being assembled from them
+func (r *UploadRepo) IsActive(ctx context.Context, uploadID string) (bool, error) {
+	var active bool
+	err := r.db.QueryRow(ctx,
+		`SELECT EXISTS(SELECT 1 FROM chunk_uploads
+		WHERE id=$1 AND (status IN ('pending', 'uploading') AND expires_at > NOW() OR status='assembling'))`,
+		uploadID).Scan(&active)
+	return active, err
+}
+
+// LockChunk serializes writes of one chunk number until the transaction ends,
+// leaving other chunks of the session free to upload in parallel
+func (r *UploadRepo) LockChunk(ctx context.Context, uploadID string, chunkNum int) error {
+	_, err := r.db.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('chunk:' || $1 || ':' || $2::text))`,
+		uploadID, chunkNum)
+	return err
+}
+
+// GetPart returns a received chunk
+func (r *UploadRepo) GetPart(ctx context.Context, uploadID string, chunkNum int) (*models.ChunkPart, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT `+partColumns+` FROM chunk_upload_parts WHERE upload_id=$1 AND chunk_number=$2`, uploadID, chunkNum)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToAddrOfStructByPos[models.ChunkPart])
+}
+
+// ListParts returns every received chunk in order
+func (r *UploadRepo) ListParts(ctx context.Context, uploadID string) ([]models.ChunkPart, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT `+partColumns+` FROM chunk_upload_parts WHERE upload_id=$1 ORDER BY chunk_number`, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[models.ChunkPart])
+}
+
+// SavePart records a received chunk, replacing an earlier copy of the same
+// chunk, and moves the session to uploading
+func (r *UploadRepo) SavePart(ctx context.Context, p *models.ChunkPart) error {
+	_, err := r.db.Exec(ctx,
+		`INSERT INTO chunk_upload_parts (upload_id, chunk_number, size, checksum, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (upload_id, chunk_number) DO UPDATE SET size=$3, checksum=$4, created_at=$5`,
+		p.UploadID, p.ChunkNumber, p.Size, p.Checksum, p.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(ctx,
+		`UPDATE chunk_uploads SET status='uploading',
+		uploaded_chunks = CASE WHEN $1 = ANY(uploaded_chunks) THEN uploaded_chunks
+			ELSE array_append(uploaded_chunks, $1) END
+		WHERE id=$2`,
+		p.ChunkNumber, p.UploadID)
+	return err
+}
+
+// AppendPart records a tus part and the new offset
+func (r *UploadRepo) AppendPart(ctx context.Context, uploadID string, partNum int, offset int64) error {
+	_, err := r.db.Exec(ctx,
+		`UPDATE chunk_uploads SET uploaded_chunks = array_append(uploaded_chunks, $1), total_chunks=$1 + 1,
+		upload_offset=$2, status='uploading' WHERE id=$3`,
+		partNum, offset, uploadID)
+	return err
+}
+
+// Delete removes the user's upload session if it is still in status. A
+// session that has moved on since, for instance to assembling, is left
+// alone as pgx.ErrNoRows.
+func (r *UploadRepo) Delete(ctx context.Context, uploadID, userID, status string) error {
+	tag, err := r.db.Exec(ctx,
+		`DELETE FROM chunk_uploads WHERE id=$1 AND user_id=$2 AND status=$3`, uploadID, userID, status)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// StartAssembly moves the user's active session to assembling. Only one
+// caller can win, so a session is never assembled twice.
+func (r *UploadRepo) StartAssembly(ctx context.Context, uploadID, userID string) error {
+	tag, err := r.db.Exec(ctx,
+		`UPDATE chunk_uploads SET status='assembling', assembly_started_at=NOW()
+		WHERE id=$1 AND user_id=$2 AND status IN ('pending', 'uploading') AND expires_at > NOW()`,
+		uploadID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// Complete marks an assembling session completed and records the file it
+// produced. It returns pgx.ErrNoRows if the session is no longer assembling,
+// e.g. because the reaper gave up on it.
+func (r *UploadRepo) Complete(ctx context.Context, uploadID, fileID string) error {
+	tag, err := r.db.Exec(ctx,
+		`UPDATE chunk_uploads SET status='completed', file_id=$1, error=NULL
+		WHERE id=$2 AND status='assembling'`, fileID, uploadID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// Fail marks an assembling session failed with the reason
+func (r *UploadRepo) Fail(ctx context.Context, uploadID, reason string) error {
+	_, err := r.db.Exec(ctx,
+		`UPDATE chunk_uploads SET status='failed', error=$1 WHERE id=$2 AND status='assembling'`, reason, uploadID)
+	return err
+}
+
+// ExpireStale moves every session still accepting data past its expiry to
+// expired and returns their IDs
+func (r *UploadRepo) ExpireStale(ctx context.Context) ([]string, error) {
+	rows, err := r.db.Query(ctx,
+		`UPDATE chunk_uploads SET status='expired'
+		WHERE status IN ('pending', 'uploading') AND expires_at <= NOW()
+		RETURNING id`)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// FailStuck fails every session that started assembling before cutoff with
+// the reason and returns their IDs
+func (r *UploadRepo) FailStuck(ctx context.Context, cutoff time.Time, reason string) ([]string, error) {
+	rows, err := r.db.Query(ctx,
+		`UPDATE chunk_uploads SET status='failed', error=$1
+		WHERE status='assembling' AND COALESCE(assembly_started_at, created_at) < $2
+		RETURNING id`, reason, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// Extend moves the expiry of the user's active session
+func (r *UploadRepo) Extend(ctx context.Context, uploadID, userID string, expiresAt time.Time) error {
+	tag, err := r.db.Exec(ctx,
+		`UPDATE chunk_uploads SET expires_at=$1
+		WHERE id=$2 AND user_id=$3 AND status IN ('pending', 'uploading') AND expires_at > NOW()`,
+		expiresAt, uploadID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
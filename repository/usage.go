@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+)
+
+// UsageRepo answers how much storage users have and use.
+//
+// Usage policy: every file a user owns counts at its full size, including
+// files in the trash, even when its content is deduplicated against other
+// files or other users. Previous versions don't count. Active and assembling
+// upload sessions reserve their declared total size until they complete,
+// fail or expire.
+type UsageRepo struct {
+	db DBTX
+}
+
+// GetQuota returns the user's effective quota
+func (r *UsageRepo) GetQuota(ctx context.Context, userID string) (*models.Quota, error) {
+	return r.quota(ctx, userID, "")
+}
+
+// LockQuota returns the user's effective quota and locks the user row, so
+// concurrent uploads by the same user are checked one at a time
+func (r *UsageRepo) LockQuota(ctx context.Context, userID string) (*models.Quota, error) {
+	return r.quota(ctx, userID, " FOR UPDATE OF u")
+}
+
+func (r *UsageRepo) quota(ctx context.Context, userID, lock string) (*models.Quota, error) {
+	var q models.Quota
+	err := r.db.QueryRow(ctx,
+		`SELECT p.id, p.name, COALESCE(u.quota_bytes, p.quota_bytes)
+		FROM users u JOIN plans p ON p.id = u.plan_id WHERE u.id=$1`+lock, userID).Scan(&q.PlanID, &q.PlanName, &q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// Used returns the bytes counted against the user's quota
+func (r *UsageRepo) Used(ctx context.Context, userID string) (int64, error) {
+	var used int64
+	err := r.db.QueryRow(ctx,
+		`SELECT COALESCE(SUM(file_size), 0)::BIGINT FROM files WHERE user_id=$1 AND NOT is_folder`, userID).Scan(&used)
+	return used, err
+}
+
+// Reserved returns the bytes held by active upload sessions into the user's
+// folders, whoever is uploading, leaving out excludeUploadID
+func (r *UsageRepo) Reserved(ctx context.Context, userID, excludeUploadID string) (int64, error) {
+	var reserved int64
+	err := r.db.QueryRow(ctx,
+		`SELECT COALESCE(SUM(total_size), 0)::BIGINT FROM chunk_uploads
+		WHERE owner_id=$1 AND (status IN ('pending', 'uploading') AND expires_at > NOW() OR status='assembling')
+		AND id<>$2`,
+		userID, excludeUploadID).Scan(&reserved)
+	return reserved, err
+}
+
+// Trashed returns the bytes of the user's files in the trash
+func (r *UsageRepo) Trashed(ctx context.Context, userID string) (int64, error) {
+	var trashed int64
+	err := r.db.QueryRow(ctx,
+		`SELECT COALESCE(SUM(file_size), 0)::BIGINT FROM files
+		WHERE user_id=$1 AND NOT is_folder AND deleted_at IS NOT NULL`, userID).Scan(&trashed)
+	return trashed, err
+}
+
+// Versions returns the bytes of the previous versions of the user's files
+func (r *UsageRepo) Versions(ctx context.Context, userID string) (int64, error) {
+	var versions int64
+	err := r.db.QueryRow(ctx,
+		`SELECT COALESCE(SUM(v.file_size), 0)::BIGINT FROM file_versions v
+		JOIN files f ON f.id = v.file_id WHERE f.user_id=$1`, userID).Scan(&versions)
+	return versions, err
+}
+
+// ByFolder returns the usage of every item directly inside parentID (nil
+// for the root), largest first. Trashed items are left out.
+func (r *UsageRepo) ByFolder(ctx context.Context, userID string, parentID *string) ([]models.FolderUsage, error) {
+	rows, err := r.db.Query(ctx,
+		`WITH RECURSIVE tree AS (
+			SELECT id, id AS top, is_folder, file_size FROM files
+			WHERE user_id=$1 AND parent_id IS NOT DISTINCT FROM $2 AND deleted_at IS NULL
+			UNION ALL
+			SELECT f.id, t.top, f.is_folder, f.file_size FROM files f JOIN tree t ON f.parent_id = t.id
+			WHERE f.deleted_at IS NULL
+		)
+		SELECT top.id, top.original_name, top.is_folder,
+			COALESCE(SUM(t.file_size) FILTER (WHERE NOT t.is_folder), 0)::BIGINT,
+			COUNT(*) FILTER (WHERE NOT t.is_folder)
+		FROM tree t JOIN files top ON top.id = t.top
+		GROUP BY top.id, top.original_name, top.is_folder
+		ORDER BY 4 DESC, top.original_name`, userID, parentID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[models.FolderUsage])
+}
+
+// ByType returns the usage of the user's files grouped by extension, largest first
+func (r *UsageRepo) ByType(ctx context.Context, userID string) ([]models.TypeUsage, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT COALESCE(LOWER(SUBSTRING(original_name FROM '\.([^./]+)$')), '') AS ext,
+			COALESCE(SUM(file_size), 0)::BIGINT, COUNT(*)
+		FROM files WHERE user_id=$1 AND NOT is_folder AND deleted_at IS NULL
+		GROUP BY ext ORDER BY 2 DESC, ext`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[models.TypeUsage])
+}
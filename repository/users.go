@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/pk0205/dropbox-2.0/models"
+)
+
+// UserRepo reads and writes the users table
+type UserRepo struct {
+	db DBTX
+}
+
+const userColumns = `id, firstName, lastName, username, email, password`
+
+// List returns every user, including the stored password hash
+func (r *UserRepo) List(ctx context.Context) ([]models.User, error) {
+	rows, err := r.db.Query(ctx, `SELECT `+userColumns+` FROM users`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		var u models.User
+		if err := rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Username, &u.Email, &u.Password); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// UsernameExists reports whether the username is taken
+func (r *UserRepo) UsernameExists(ctx context.Context, username string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM users WHERE username=$1)", username).Scan(&exists)
+	return exists, err
+}
+
+// EmailExists reports whether the email is already registered
+func (r *UserRepo) EmailExists(ctx context.Context, email string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM users WHERE email=$1)", email).Scan(&exists)
+	return exists, err
+}
+
+// Create inserts a user with an already hashed password
+func (r *UserRepo) Create(ctx context.Context, user *models.User, hashedPassword []byte) error {
+	_, err := r.db.Exec(ctx,
+		"INSERT INTO users (id, firstName, lastName, username, email, password) VALUES ($1, $2, $3, $4, $5, $6)",
+		user.ID, user.FirstName, user.LastName, user.Username, user.Email, hashedPassword)
+	return err
+}
+
+// GetByLogin finds a user by email or username, returning the password hash separately
+func (r *UserRepo) GetByLogin(ctx context.Context, emailOrUsername string) (*models.User, string, error) {
+	return r.getOne(ctx, `SELECT `+userColumns+` FROM users WHERE email=$1 OR username=$1`, emailOrUsername)
+}
+
+// GetByUsername finds a user by username, returning the password hash separately
+func (r *UserRepo) GetByUsername(ctx context.Context, username string) (*models.User, string, error) {
+	return r.getOne(ctx, `SELECT `+userColumns+` FROM users WHERE username=$1`, username)
+}
+
+func (r *UserRepo) getOne(ctx context.Context, sql string, arg string) (*models.User, string, error) {
+	var user models.User
+	var hashedPassword string
+	err := r.db.QueryRow(ctx, sql, arg).Scan(
+		&user.ID, &user.FirstName, &user.LastName, &user.Username, &user.Email, &hashedPassword)
+	if err != nil {
+		return nil, "", err
+	}
+	return &user, hashedPassword, nil
+}
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pk0205/dropbox-2.0/models"
+)
+
+// VersionRepo reads and writes the history of previous file contents.
+// The current content always lives on the files row itself.
+type VersionRepo struct {
+	db DBTX
+}
+
+const versionColumns = `id, file_id, version_num, COALESCE(file_path, ''), blob_id, file_size, checksum, created_at`
+
+// Create archives a previous version
+func (r *VersionRepo) Create(ctx context.Context, v *models.FileVersion) error {
+	_, err := r.db.Exec(ctx,
+		`INSERT INTO file_versions (id, file_id, version_num, file_path, blob_id, file_size, checksum, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		v.ID, v.FileID, v.VersionNum, nullIfEmpty(v.FilePath), v.BlobID, v.FileSize, v.Checksum, v.CreatedAt)
+	return err
+}
+
+// List returns a file's previous versions, newest first
+func (r *VersionRepo) List(ctx context.Context, fileID string) ([]models.FileVersion, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT `+versionColumns+` FROM file_versions WHERE file_id=$1 ORDER BY version_num DESC`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[models.FileVersion])
+}
+
+// Get returns one previous version of a file
+func (r *VersionRepo) Get(ctx context.Context, fileID string, versionNum int) (*models.FileVersion, error) {
+	rows, err := r.db.Query(ctx,
+		`SELECT `+versionColumns+` FROM file_versions WHERE file_id=$1 AND version_num=$2`, fileID, versionNum)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToAddrOfStructByPos[models.FileVersion])
+}
+
+// PrunedVersion is a version Prune deleted. BlobID is empty for legacy
+// versions stored before deduplication, which hold no blob reference.
+type PrunedVersion struct {
+	ID     string
+	BlobID string
+}
+
+// Prune deletes previous versions beyond the newest keep (0 keeps all) or
+// created before olderThan (nil ignores age), for one file or for every file
+// when fileID is empty. Versions a share link is pinned to are kept. It
+// returns every deleted version.
+func (r *VersionRepo) Prune(ctx context.Context, fileID string, keep int, olderThan *time.Time) ([]PrunedVersion, error) {
+	rows, err := r.db.Query(ctx,
+		`DELETE FROM file_versions WHERE id IN (
+			SELECT id FROM (
+				SELECT id, file_id, version_num, created_at,
+				ROW_NUMBER() OVER (PARTITION BY file_id ORDER BY version_num DESC) AS rn
+				FROM file_versions WHERE ($1 = '' OR file_id = $1)
+			) ranked
+			WHERE (($2 > 0 AND ranked.rn > $2) OR ($3::timestamp IS NOT NULL AND ranked.created_at < $3))
+			AND NOT EXISTS (
+				SELECT 1 FROM share_links sl
+				WHERE sl.file_id = ranked.file_id AND sl.pinned_version = ranked.version_num
+			)
+		)
+		RETURNING id, COALESCE(blob_id, '')`, fileID, keep, olderThan)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[PrunedVersion])
+}
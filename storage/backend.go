@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a key does not exist in the backend
+var ErrNotFound = errors.New("storage: object not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend is the blob store the handlers read and write file bytes through.
+// Keys are slash separated relative paths such as "users/<userID>/<fileID>.txt"
+// or "chunks/<uploadID>/chunk_3".
+type Backend interface {
+	// Put stores everything read from r under key, replacing any existing object
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// Get opens the whole object for reading
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// GetRange opens length bytes starting at offset (length < 0 reads to the end)
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Delete removes the object; deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// List returns every object whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// Importer is implemented by backends that can take ownership of a local
+// file without copying it
+type Importer interface {
+	// TempDir is where files destined for Import should be created so the
+	// move is a rename on the same filesystem
+	TempDir() string
+	// Import moves the file at path into place under key
+	Import(ctx context.Context, key, path string) error
+}
+
+// appTempDir holds the temp files of backends that can't import files. It
+// is the app's own directory inside os.TempDir, so RemoveTemp never touches
+// files of other processes on the host.
+func appTempDir() string {
+	return filepath.Join(os.TempDir(), "dropbox-tmp")
+}
+
+// tempPattern returns the directory and name pattern CreateTemp uses for b
+func tempPattern(b Backend, pattern string) (string, string) {
+	if im, ok := b.(Importer); ok {
+		return im.TempDir(), ".tmp-" + pattern
+	}
+	return appTempDir(), pattern
+}
+
+// CreateTemp creates a temp file for content that will be stored in b with
+// PutFile, next to the objects when b can import files and in the app's
+// temp directory otherwise
+func CreateTemp(b Backend, pattern string) (*os.File, error) {
+	dir, pattern := tempPattern(b, pattern)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(dir, pattern)
+}
+
+// RemoveTemp deletes temp files CreateTemp made for pattern that were last
+// written before cutoff, such as those left behind by a crashed upload, and
+// returns how many it removed
+func RemoveTemp(b Backend, pattern string, cutoff time.Time) (int, error) {
+	dir, pattern := tempPattern(b, pattern)
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil || info.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(m); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// PutFile stores the file at path under key, renaming it into place when b
+// is an Importer and uploading a copy otherwise. The file at path is gone
+// once PutFile succeeds.
+func PutFile(ctx context.Context, b Backend, key, path string) error {
+	if im, ok := b.(Importer); ok {
+		return im.Import(ctx, key, path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := b.Put(ctx, key, f); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// DeletePrefix removes every object under prefix (e.g. a chunk directory)
+func DeletePrefix(ctx context.Context, b Backend, prefix string) error {
+	objects, err := b.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := b.Delete(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BlobKey returns the content-addressed key for a SHA-256 checksum,
+// fanned out by its first two byte pairs: blobs/ab/cd/abcd...
+func BlobKey(checksum string) string {
+	if len(checksum) < 4 {
+		return "blobs/" + checksum
+	}
+	return "blobs/" + checksum[0:2] + "/" + checksum[2:4] + "/" + checksum
+}
+
+// PathKey converts a filesystem path recorded before the backend abstraction
+// (e.g. storage/users/<userID>/<fileID>.txt) into a key relative to root
+func PathKey(filePath, root string) string {
+	p := filepath.ToSlash(filepath.Clean(filePath))
+	return strings.TrimPrefix(p, filepath.ToSlash(filepath.Clean(root))+"/")
+}
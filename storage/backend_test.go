@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoveTempStaysInAppDir(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	old := time.Now().Add(-2 * time.Hour)
+
+	// Another process's file that happens to match the pattern
+	foreign := filepath.Join(tmp, "upload-foreign")
+	if err := os.WriteFile(foreign, []byte("not ours"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(foreign, old, old)
+
+	store, err := NewS3(S3Config{Endpoint: "http://127.0.0.1:1", Bucket: "files"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := CreateTemp(store, "upload-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Close()
+	os.Chtimes(stale.Name(), old, old)
+	fresh, err := CreateTemp(store, "upload-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh.Close()
+
+	if dir := filepath.Dir(stale.Name()); dir != filepath.Join(tmp, "dropbox-tmp") {
+		t.Errorf("temp file created in %s", dir)
+	}
+
+	removed, err := RemoveTemp(store, "upload-*", time.Now().Add(-time.Hour))
+	if err != nil || removed != 1 {
+		t.Fatalf("RemoveTemp = %d, %v; want 1", removed, err)
+	}
+	if _, err := os.Stat(stale.Name()); !os.IsNotExist(err) {
+		t.Error("stale temp file was kept")
+	}
+	if _, err := os.Stat(fresh.Name()); err != nil {
+		t.Error("fresh temp file was removed")
+	}
+	if _, err := os.Stat(foreign); err != nil {
+		t.Error("file outside the app's temp directory was removed")
+	}
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// FromEnv builds the backend selected by STORAGE_BACKEND ("local" or "s3").
+// The local backend keeps files under localDir; the S3 backend stores them in
+// S3_BUCKET under the given key prefix.
+func FromEnv(localDir, prefix string) (Backend, error) {
+	switch strings.ToLower(os.Getenv("STORAGE_BACKEND")) {
+	case "", "local":
+		return NewLocal(localDir)
+	case "s3":
+		return NewS3(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			Prefix:    prefix,
+			PathStyle: os.Getenv("S3_PATH_STYLE") != "false",
+		})
+	default:
+		return nil, fmt.Errorf("storage: unknown STORAGE_BACKEND %q", os.Getenv("STORAGE_BACKEND"))
+	}
+}